@@ -0,0 +1,615 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+func runTUI(opts options) {
+	d, err := opts.newDaemon()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer d.StateDB.Close()
+
+	if opts.healthAddr != "" {
+		if err := d.ServeHealth(opts.healthAddr); err != nil {
+			fmt.Fprintf(os.Stderr, "error: health server: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	out, closeOut := opts.reporter()
+	defer closeOut()
+	if out.events != nil {
+		d.Executor.OnEvent = out.events.HookEvent
+		stop := make(chan struct{})
+		defer close(stop)
+		go streamProgress(d, out.events, progressInterval, stop)
+	}
+
+	p := tea.NewProgram(NewModel(d), tea.WithAltScreen())
+	if _, err := p.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// progressInterval is how often run commands report progress.
+const progressInterval = 5 * time.Second
+
+// reporter is where run commands send their output.
+type reporter struct {
+	text   bool         // print human-readable progress lines
+	tty    bool         // text output goes to a terminal; redraw progress in place
+	events *EventStream // nil when no machine-readable output was requested
+}
+
+func runStatus(opts options, jsonOut bool) {
+	d, err := opts.newDaemon()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer d.StateDB.Close()
+
+	if err := d.Poll(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	records := d.Records()
+	if jsonOut {
+		out := make([]statusJSON, 0, len(records))
+		for _, r := range records {
+			out = append(out, newStatusJSON(r))
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(records) == 0 {
+		fmt.Println("No migrations found.")
+		return
+	}
+
+	fmt.Printf("%-12s %-32s %-16s %-12s %-10s %-12s %s\n", "STATUS", "NAME", "TARGET", "LAST ID", "PROGRESS", "AFFECTED", "AGE")
+	fmt.Println(strings.Repeat("-", 110))
+	for _, r := range records {
+		target := opts.service
+		if r.TargetService.Valid {
+			target = r.TargetService.String
+		}
+		lastID := "—"
+		if r.HasCheckpoint() {
+			lastID = fmt.Sprintf("%d", r.LastCompletedID)
+		}
+		progress := "—"
+		if pct, ok := statusPercent(r); ok {
+			progress = fmt.Sprintf("%.1f%%", pct)
+		}
+		affected := "—"
+		if r.TotalAffected > 0 {
+			affected = FormatNumber(r.TotalAffected)
+		}
+		fmt.Printf("%-12s %-32s %-16s %-12s %-10s %-12s %s\n",
+			r.Status, r.Name, target, lastID, progress, affected, FormatETA(time.Since(r.UpdatedAt))+" ago")
+	}
+}
+
+// statusPercent returns how far a migration has got, treating completed
+// migrations as done whether or not they were batched.
+func statusPercent(r MigrationRecord) (float64, bool) {
+	if r.Status == "completed" {
+		return 100, true
+	}
+	return r.Progress()
+}
+
+// statusJSON is the machine-readable form of a psc_migrations row.
+type statusJSON struct {
+	Name            string     `json:"name"`
+	Filename        string     `json:"filename"`
+	Status          string     `json:"status"`
+	TargetService   *string    `json:"target_service"`
+	BatchColumn     *string    `json:"batch_column"`
+	ChunkSize       *int32     `json:"chunk_size"`
+	Parallelism     *int32     `json:"parallelism"`
+	MinID           *int64     `json:"min_id"`
+	MaxID           *int64     `json:"max_id"`
+	LastCompletedID int64      `json:"last_completed_id"`
+	TotalAffected   int64      `json:"total_affected_rows"`
+	ErrorCount      int        `json:"error_count"`
+	LastError       *string    `json:"last_error"`
+	FailedChunks    *string    `json:"failed_chunks"`
+	Percent         *float64   `json:"percent"`
+	AgeSeconds      int64      `json:"age_seconds"`
+	StartedAt       *time.Time `json:"started_at"`
+	CompletedAt     *time.Time `json:"completed_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+func newStatusJSON(r MigrationRecord) statusJSON {
+	s := statusJSON{
+		Name:            r.Name,
+		Filename:        r.Filename,
+		Status:          r.Status,
+		LastCompletedID: r.LastCompletedID,
+		TotalAffected:   r.TotalAffected,
+		ErrorCount:      r.ErrorCount,
+		UpdatedAt:       r.UpdatedAt,
+		AgeSeconds:      int64(time.Since(r.UpdatedAt).Seconds()),
+	}
+	if pct, ok := statusPercent(r); ok {
+		s.Percent = &pct
+	}
+	if r.TargetService.Valid {
+		s.TargetService = &r.TargetService.String
+	}
+	if r.BatchColumn.Valid {
+		s.BatchColumn = &r.BatchColumn.String
+	}
+	if r.ChunkSize.Valid {
+		s.ChunkSize = &r.ChunkSize.Int32
+	}
+	if r.Parallelism.Valid {
+		s.Parallelism = &r.Parallelism.Int32
+	}
+	if r.MinID.Valid {
+		s.MinID = &r.MinID.Int64
+	}
+	if r.MaxID.Valid {
+		s.MaxID = &r.MaxID.Int64
+	}
+	if r.LastError.Valid {
+		s.LastError = &r.LastError.String
+	}
+	if r.FailedChunks.Valid {
+		s.FailedChunks = &r.FailedChunks.String
+	}
+	if r.StartedAt.Valid {
+		s.StartedAt = &r.StartedAt.Time
+	}
+	if r.CompletedAt.Valid {
+		s.CompletedAt = &r.CompletedAt.Time
+	}
+	return s
+}
+
+// Exit codes for the run commands, so wrapping scripts can branch on what
+// happened. Usage errors exit with 2, as the flag package does.
+const (
+	exitCompleted    = 0
+	exitFailed       = 1
+	exitUsage        = 2
+	exitFailedChunks = 3 // completed, but some chunks still failed after retry
+	exitCancelled    = 4
+	exitConnection   = 5
+	exitValidation   = 6
+)
+
+// exitCode maps a run error to the exit code describing it.
+func exitCode(err error) int {
+	var connErr *ConnectError
+	var valErr *ValidationError
+	switch {
+	case err == nil:
+		return exitCompleted
+	case errors.Is(err, context.Canceled):
+		return exitCancelled
+	case errors.As(err, &connErr):
+		return exitConnection
+	case errors.As(err, &valErr):
+		return exitValidation
+	}
+	return exitFailed
+}
+
+// fatal prints err and exits with the code describing it.
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	os.Exit(exitCode(err))
+}
+
+// hasFailedChunks reports whether a migration finished with chunks that
+// still failed after retry.
+func hasFailedChunks(d *Daemon, name string) bool {
+	r, err := GetMigrationByName(d.StateDB, name)
+	return err == nil && r.FailedChunks.Valid
+}
+
+func runSingle(opts options, name string) {
+	d, err := opts.newDaemon()
+	if err != nil {
+		fatal(err)
+	}
+	defer d.StateDB.Close()
+
+	if err := d.Poll(); err != nil {
+		fatal(err)
+	}
+
+	m := d.GetMigration(name)
+	if m == nil {
+		errs := d.PopErrors()
+		unparsed := d.Unparsed(name)
+		if unparsed {
+			fmt.Fprintf(os.Stderr, "migration %q does not parse\n", name)
+		} else {
+			fmt.Fprintf(os.Stderr, "migration %q not found in repo\n", name)
+		}
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "error: %s\n", e)
+		}
+		if unparsed {
+			os.Exit(exitValidation)
+		}
+		os.Exit(exitFailed)
+	}
+
+	record, err := GetMigrationByName(d.StateDB, name)
+	if err != nil {
+		fatal(err)
+	}
+
+	out, closeOut := opts.reporter()
+	defer closeOut()
+	if out.events != nil {
+		d.Executor.OnEvent = out.events.HookEvent
+	}
+	switch {
+	case record.Status == "completed" && !record.NeedsRetry():
+		out.events.Emit(Event{Event: "skipped", Name: name, TotalAffected: record.TotalAffected})
+		if out.text {
+			fmt.Printf("Migration %q is already completed.\n", name)
+		}
+		return
+	case record.Status == "running" && out.text:
+		// Left by a process that died mid-run, unless its advisory lock is
+		// still held, in which case Run refuses.
+		fmt.Printf("Migration %q is marked running; resuming if no other runner holds its lock.\n", name)
+	}
+
+	if err := executeWithProgress(opts, d, m, record, out); err != nil {
+		fatal(err)
+	}
+	if hasFailedChunks(d, name) {
+		os.Exit(exitFailedChunks)
+	}
+}
+
+func runUp(opts options) {
+	d, err := opts.newDaemon()
+	if err != nil {
+		fatal(err)
+	}
+	defer d.StateDB.Close()
+
+	if err := d.Poll(); err != nil {
+		fatal(err)
+	}
+	if errs := d.PopErrors(); len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Fprintf(os.Stderr, "error: %s\n", e)
+		}
+		os.Exit(exitValidation)
+	}
+
+	out, closeOut := opts.reporter()
+	defer closeOut()
+	if out.events != nil {
+		d.Executor.OnEvent = out.events.HookEvent
+	}
+	ran, partial := 0, 0
+	for _, r := range d.Records() {
+		// Rows whose file was removed can't be run; migrate clean drops them.
+		m := d.GetMigration(r.Name)
+		if m == nil {
+			continue
+		}
+		switch r.Status {
+		case "completed":
+			continue
+		case "pending", "running":
+			// A stale "running" resumes; Run's advisory lock refuses a live one.
+		default:
+			// Running later migrations past an unfinished one would let a CI
+			// gate pass while a datafix is still failed or cancelled.
+			fmt.Fprintf(os.Stderr, "error: migration %q is %s; fix it and rerun with: %s\n",
+				r.Name, r.Status, resumeCommand(opts, r.Name))
+			os.Exit(exitFailed)
+		}
+		record := r
+		if err := executeWithProgress(opts, d, m, &record, out); err != nil {
+			fatal(err)
+		}
+		if hasFailedChunks(d, m.Name) {
+			partial++
+		}
+		ran++
+	}
+	if out.text {
+		switch {
+		case ran == 0:
+			fmt.Println("No pending migrations.")
+		case partial > 0:
+			fmt.Printf("Ran %d migrations, %d with failed chunks.\n", ran, partial)
+		default:
+			fmt.Printf("Ran %d migrations.\n", ran)
+		}
+	}
+	if partial > 0 {
+		os.Exit(exitFailedChunks)
+	}
+}
+
+// executeWithProgress runs a migration synchronously, reporting progress
+// while it executes.
+func executeWithProgress(opts options, d *Daemon, m *Migration, record *MigrationRecord, out reporter) error {
+	out.events.Emit(Event{Event: "start", Name: m.Name, Service: m.Service, Table: migrationTable(m),
+		TotalAffected: record.TotalAffected})
+	if out.text {
+		fmt.Printf("Running migration: %s\n", m.Name)
+	}
+	done := make(chan struct{})
+	go printProgress(d.Executor, m, done, out)
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go stopOnSignal(d.Executor, m, sigs, done)
+	err := d.Executor.Run(m, record)
+	signal.Stop(sigs)
+	close(done)
+	for _, msg := range d.PopErrors() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", msg)
+	}
+	if out.events != nil {
+		out.events.Emit(finishEvent(d, m, err))
+	}
+	if errors.Is(err, context.Canceled) {
+		fmt.Fprintf(os.Stderr, "Resume with: %s\n", resumeCommand(opts, m.Name))
+	}
+	if err != nil || !out.text {
+		return err
+	}
+
+	if record, err := GetMigrationByName(d.StateDB, m.Name); err == nil && record.ErrorCount > 0 {
+		fmt.Printf("Done with %d errors (last: %s).\n", record.ErrorCount, record.LastError.String)
+		return nil
+	}
+	fmt.Println("Done.")
+	return nil
+}
+
+// stopOnSignal drains a running migration on the first SIGINT or SIGTERM,
+// letting in-flight chunks finish so progress is checkpointed, and cancels
+// it outright on the second.
+func stopOnSignal(exec *Executor, m *Migration, sigs <-chan os.Signal, done <-chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-sigs:
+	}
+	if m.IsBatched() {
+		fmt.Fprintf(os.Stderr, "\nStopping %s after in-flight chunks finish (signal again to abort them)...\n", m.Name)
+		exec.Drain(m.Name)
+	} else {
+		fmt.Fprintf(os.Stderr, "\nWaiting for %s to finish (signal again to cancel it)...\n", m.Name)
+	}
+	select {
+	case <-done:
+		return
+	case <-sigs:
+	}
+	fmt.Fprintf(os.Stderr, "Cancelling %s...\n", m.Name)
+	exec.Cancel(m.Name)
+}
+
+// resumeCommand is the command line that continues a stopped migration with
+// the same shared flags: session settings, hooks and logging carry over.
+func resumeCommand(opts options, name string) string {
+	args := []string{"psc", "--repo", opts.repo, "--service", opts.service}
+	if opts.env != "" {
+		args = append(args, "--env", opts.env)
+	}
+	names := make([]string, 0, len(opts.settings))
+	for n := range opts.settings {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		args = append(args, "--set", n+"="+opts.settings[n])
+	}
+	for _, event := range []string{hookBeforeRun, hookAfterChunk, hookAfterRun, hookOnError} {
+		for _, c := range opts.hooks[event] {
+			args = append(args, "--hook", event+"="+c)
+		}
+	}
+	if opts.logFile != "" {
+		args = append(args, "--log-file", opts.logFile)
+	}
+	if opts.logLevel != "info" {
+		args = append(args, "--log-level", opts.logLevel)
+	}
+	args = append(args, "migrate", "run", name)
+	for i, a := range args {
+		args[i] = shellQuote(a)
+	}
+	return strings.Join(args, " ")
+}
+
+// shellQuote quotes s for a POSIX shell when it contains anything beyond
+// plainly safe characters.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:=@,+") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// finishEvent describes how a run ended, using the final psc_migrations row
+// when it can be read.
+func finishEvent(d *Daemon, m *Migration, err error) Event {
+	ev := Event{Event: "completed", Name: m.Name, Service: m.Service}
+	switch {
+	case errors.Is(err, context.Canceled):
+		ev.Event = "cancelled"
+	case err != nil:
+		ev.Event = "failed"
+		ev.Error = err.Error()
+	}
+	if r, err := GetMigrationByName(d.StateDB, m.Name); err == nil {
+		ev.TotalAffected = r.TotalAffected
+		ev.ErrorCount = r.ErrorCount
+		ev.FailedChunks = r.FailedChunks.String
+	}
+	return ev
+}
+
+// printProgress reports a running migration until done is closed, as a
+// printed line and/or a progress event every progressInterval. On a terminal
+// the line is instead redrawn in place every second with a progress bar.
+func printProgress(exec *Executor, m *Migration, done <-chan struct{}, out reporter) {
+	interval := progressInterval
+	if out.tty {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastEvent := time.Now()
+	drawn := false
+	for {
+		select {
+		case <-done:
+			if drawn {
+				fmt.Println()
+			}
+			return
+		case <-ticker.C:
+		}
+		es := exec.GetState(m.Name)
+		if es == nil {
+			continue
+		}
+		if out.events != nil && time.Since(lastEvent) >= progressInterval {
+			out.events.Emit(progressEvent(m, es))
+			lastEvent = time.Now()
+		}
+		switch {
+		case out.tty:
+			fmt.Printf("\r\033[K%s", progressLine(es, true))
+			drawn = true
+		case out.text:
+			fmt.Println(progressLine(es, false))
+		}
+	}
+}
+
+// progressLine describes a running migration on one line, optionally with a
+// progress bar for batched migrations.
+func progressLine(es *ExecutionState, bar bool) string {
+	if phase := es.Phase(); phase != "" {
+		return fmt.Sprintf("  %s...", phase)
+	}
+	line := fmt.Sprintf("  affected=%s", FormatNumber(es.TotalAffected.Load()))
+	if minID, maxID, ok := es.IDRange(); ok {
+		lastID := es.LastCompletedID.Load()
+		pct := rangeProgress(lastID, minID, maxID)
+		if bar {
+			line = fmt.Sprintf("  [%s] %.1f%%  id %s / %s%s", renderBar(pct, 30), pct,
+				FormatNumber(lastID), FormatNumber(maxID), line)
+		} else {
+			line = fmt.Sprintf("  id %s / %s (%.1f%%)%s", FormatNumber(lastID), FormatNumber(maxID), pct, line)
+		}
+	}
+	if rate := es.Rate.Load(); rate > 0 {
+		line += fmt.Sprintf("  ~%s rows/sec", FormatNumber(rate))
+	}
+	line += fmt.Sprintf("  elapsed=%s", time.Since(es.StartedAt).Round(time.Second))
+	if eta, ok := es.ETA(); ok {
+		line += fmt.Sprintf("  eta=%s", FormatETA(eta))
+	}
+	if es.Paused.Load() {
+		line += fmt.Sprintf("  paused (replica lag %s)", time.Duration(es.ReplicaLag.Load()).Round(time.Second))
+	}
+	return line
+}
+
+// runClean deletes psc_migrations rows whose migration file is no longer in
+// the repo. Rows for files that still exist are kept, since removing them
+// would make psc treat the migration as pending again.
+func runClean(opts options, olderThan time.Duration, dryRun bool) {
+	d, err := opts.newDaemon()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer d.StateDB.Close()
+
+	if err := d.Poll(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	removed := 0
+	for _, r := range d.Records() {
+		// A migration still defined in the repo keeps its row even if its
+		// file was renamed; filename is only refreshed while pending.
+		if d.GetMigration(r.Name) != nil {
+			continue
+		}
+		path := filepath.Join(d.RepoPath, filepath.Base(r.Filename))
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if r.Status == "running" || time.Since(r.UpdatedAt) < olderThan {
+			continue
+		}
+		if dryRun {
+			fmt.Printf("would remove %s (%s, updated %s ago)\n", r.Name, r.Status, FormatETA(time.Since(r.UpdatedAt)))
+			removed++
+			continue
+		}
+		if err := DeleteMigration(d.StateDB, r.Name); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s: %v\n", r.Name, err)
+			continue
+		}
+		fmt.Printf("removed %s (%s)\n", r.Name, r.Status)
+		removed++
+	}
+	if removed == 0 {
+		fmt.Println("Nothing to clean.")
+	}
+}
+
+func runCancel(opts options, name string) {
+	// Cancel only works in TUI/daemon mode since it requires the running context.
+	// For CLI, we just set the status to cancelled in the DB.
+	d, err := opts.newDaemon()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	defer d.StateDB.Close()
+
+	if err := UpdateStatus(d.StateDB, name, "cancelled"); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Migration %q marked as cancelled.\n", name)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestResumeCommand(t *testing.T) {
+	tests := []struct {
+		name string
+		opts options
+		want string
+	}{
+		{
+			name: "defaults",
+			opts: options{repo: ".", service: "app", logLevel: "info"},
+			want: "psc --repo . --service app migrate run backfill",
+		},
+		{
+			name: "shared flags carried over",
+			opts: options{
+				repo: "db/migrations", service: "app", env: "prod",
+				settings: settingsFlag{"work_mem": "256MB", "synchronous_commit": "off"},
+				hooks:    Hooks{hookOnError: {"notify.sh"}, hookBeforeRun: {"echo 'starting'"}},
+				logFile:  "/var/log/psc.log", logLevel: "debug",
+			},
+			want: "psc --repo db/migrations --service app --env prod" +
+				" --set synchronous_commit=off --set work_mem=256MB" +
+				` --hook 'before_run=echo '\''starting'\''' --hook on_error=notify.sh` +
+				" --log-file /var/log/psc.log --log-level debug migrate run backfill",
+		},
+	}
+	for _, tt := range tests {
+		if got := resumeCommand(tt.opts, "backfill"); got != tt.want {
+			t.Errorf("%s:\n got %s\nwant %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	connErr := &ConnectError{Service: "app", Err: errors.New("connection refused")}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"success", nil, exitCompleted},
+		{"plain failure", errors.New("boom"), exitFailed},
+		{"cancelled", context.Canceled, exitCancelled},
+		{"stopped after a drain", fmt.Errorf("stopped after id 42: %w", context.Canceled), exitCancelled},
+		{"connection", connErr, exitConnection},
+		{"wrapped connection", fmt.Errorf("state DB: %w", connErr), exitConnection},
+		{"validation", invalidf("table %s does not exist", "users"), exitValidation},
+		{"wrapped validation", fmt.Errorf("run backfill: %w", invalidf("bad")), exitValidation},
+		// A connection failure while cancelling still reports the cancel.
+		{"cancel wins", fmt.Errorf("%w: %w", context.Canceled, connErr), exitCancelled},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.err); got != tt.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -13,6 +14,7 @@ import (
 type Daemon struct {
 	RepoPath       string
 	DefaultService string
+	Env            string // selects psc:<directive>[env] overrides
 	StateDB        *sql.DB
 	Executor       *Executor
 
@@ -20,19 +22,20 @@ type Daemon struct {
 	migrations map[string]*Migration // parsed migrations by name
 	mtimes     map[string]time.Time  // file mtimes
 	records    []MigrationRecord     // cached DB records
+	unparsed   map[string]string     // names declared by files that failed to parse, by path
 	lastPoll   time.Time
 	errLog     []string
 }
 
 // NewDaemon creates a new Daemon.
-func NewDaemon(repoPath, defaultService string) (*Daemon, error) {
+func NewDaemon(repoPath, defaultService, env string) (*Daemon, error) {
 	if defaultService == "" {
 		return nil, fmt.Errorf("--service is required (default pg_service.conf service name)")
 	}
 
 	stateDB, err := ConnectService(defaultService)
 	if err != nil {
-		return nil, fmt.Errorf("connecting to state DB (%s): %w", defaultService, err)
+		return nil, fmt.Errorf("state DB: %w", &ConnectError{Service: defaultService, Err: err})
 	}
 
 	if err := EnsureMigrationsTable(stateDB); err != nil {
@@ -42,14 +45,31 @@ func NewDaemon(repoPath, defaultService string) (*Daemon, error) {
 	d := &Daemon{
 		RepoPath:       repoPath,
 		DefaultService: defaultService,
+		Env:            env,
 		StateDB:        stateDB,
 		migrations:     make(map[string]*Migration),
 		mtimes:         make(map[string]time.Time),
+		unparsed:       make(map[string]string),
 	}
 	d.Executor = NewExecutor(stateDB, defaultService)
+	d.Executor.logf = d.logError
 	return d, nil
 }
 
+// logError appends a formatted message to the error log.
+func (d *Daemon) logError(format string, args ...any) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.appendError(fmt.Sprintf(format, args...))
+}
+
+// appendError records msg in the error log and the executor's logger.
+// d.mu must be held.
+func (d *Daemon) appendError(msg string) {
+	d.errLog = append(d.errLog, msg)
+	d.Executor.Logger.Warn(msg)
+}
+
 // Poll scans the repo directory for new/changed .sql files and refreshes DB records.
 func (d *Daemon) Poll() error {
 	d.mu.Lock()
@@ -77,11 +97,16 @@ func (d *Daemon) Poll() error {
 		}
 		d.mtimes[path] = mtime
 
-		m, err := ParseMigrationFile(path)
+		m, err := ParseMigrationFile(path, d.Env)
 		if err != nil {
-			d.errLog = append(d.errLog, fmt.Sprintf("parse %s: %v", entry.Name(), err))
+			var pe *ParseError
+			if errors.As(err, &pe) && pe.Name != "" {
+				d.unparsed[path] = pe.Name
+			}
+			d.appendError(fmt.Sprintf("parse %s: %v", entry.Name(), err))
 			continue
 		}
+		delete(d.unparsed, path)
 
 		if m.Service == "" {
 			m.Service = d.DefaultService
@@ -89,7 +114,7 @@ func (d *Daemon) Poll() error {
 
 		d.migrations[m.Name] = m
 		if err := UpsertMigration(d.StateDB, m); err != nil {
-			d.errLog = append(d.errLog, fmt.Sprintf("upsert %s: %v", m.Name, err))
+			d.appendError(fmt.Sprintf("upsert %s: %v", m.Name, err))
 		}
 	}
 
@@ -119,6 +144,19 @@ func (d *Daemon) GetMigration(name string) *Migration {
 	return d.migrations[name]
 }
 
+// Unparsed reports whether a file declaring migration name failed to parse
+// when last read.
+func (d *Daemon) Unparsed(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, n := range d.unparsed {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 // RunMigration starts a migration in the background.
 func (d *Daemon) RunMigration(name string) error {
 	m := d.GetMigration(name)
@@ -133,18 +171,15 @@ func (d *Daemon) RunMigration(name string) error {
 	if err != nil {
 		return err
 	}
-	if record.Status == "completed" {
+	if record.Status == "completed" && !record.NeedsRetry() {
 		return fmt.Errorf("migration %q is already completed", name)
 	}
-	if record.Status == "running" {
-		return fmt.Errorf("migration %q is already running", name)
-	}
+	// A "running" status left by a crashed process is resumable; Run's
+	// advisory lock refuses it if another runner is still live.
 
 	go func() {
 		if err := d.Executor.Run(m, record); err != nil {
-			d.mu.Lock()
-			d.errLog = append(d.errLog, fmt.Sprintf("run %s: %v", name, err))
-			d.mu.Unlock()
+			d.logError("run %s: %v", name, err)
 		}
 	}()
 	return nil
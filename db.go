@@ -16,36 +16,67 @@ CREATE TABLE IF NOT EXISTS psc_migrations (
     batch_column TEXT,
     chunk_size INT,
     parallelism INT,
+    min_id BIGINT,
     max_id BIGINT,
     last_completed_id BIGINT DEFAULT 0,
     total_affected_rows BIGINT DEFAULT 0,
     error_count INT DEFAULT 0,
     last_error TEXT,
+    failed_chunks TEXT,
     started_at TIMESTAMPTZ,
     completed_at TIMESTAMPTZ,
     created_at TIMESTAMPTZ DEFAULT NOW(),
     updated_at TIMESTAMPTZ DEFAULT NOW()
-);`
+);
+ALTER TABLE psc_migrations ADD COLUMN IF NOT EXISTS failed_chunks TEXT;
+ALTER TABLE psc_migrations ADD COLUMN IF NOT EXISTS min_id BIGINT;`
 
 // MigrationRecord represents a row in the psc_migrations table.
 type MigrationRecord struct {
-	ID               int
-	Name             string
-	Filename         string
-	Status           string
-	TargetService    sql.NullString
-	BatchColumn      sql.NullString
-	ChunkSize        sql.NullInt32
-	Parallelism      sql.NullInt32
-	MaxID            sql.NullInt64
-	LastCompletedID  int64
-	TotalAffected    int64
-	ErrorCount       int
-	LastError        sql.NullString
-	StartedAt        sql.NullTime
-	CompletedAt      sql.NullTime
-	CreatedAt        time.Time
-	UpdatedAt        time.Time
+	ID              int
+	Name            string
+	Filename        string
+	Status          string
+	TargetService   sql.NullString
+	BatchColumn     sql.NullString
+	ChunkSize       sql.NullInt32
+	Parallelism     sql.NullInt32
+	MinID           sql.NullInt64
+	MaxID           sql.NullInt64
+	LastCompletedID int64
+	TotalAffected   int64
+	ErrorCount      int
+	LastError       sql.NullString
+	FailedChunks    sql.NullString // "start-end,..." ranges still failing
+	StartedAt       sql.NullTime
+	CompletedAt     sql.NullTime
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// NeedsRetry reports whether a completed migration still has failed chunks.
+func (r *MigrationRecord) NeedsRetry() bool {
+	return r.Status == "completed" && r.FailedChunks.Valid
+}
+
+// HasCheckpoint reports whether LastCompletedID marks real progress. A batched
+// run seeds it to just below min_id when it plans the id range, because ids
+// can be zero or negative and the column defaults to 0. Rows planned before
+// min_id was recorded only count progress above 0.
+func (r *MigrationRecord) HasCheckpoint() bool {
+	if r.MinID.Valid {
+		return r.LastCompletedID >= r.MinID.Int64
+	}
+	return r.LastCompletedID > 0
+}
+
+// Progress returns how far a batched migration is through its id range, in
+// percent, or false if the range is not known yet.
+func (r *MigrationRecord) Progress() (float64, bool) {
+	if !r.MaxID.Valid || r.MaxID.Int64 == 0 {
+		return 0, false
+	}
+	return rangeProgress(r.LastCompletedID, r.MinID.Int64, r.MaxID.Int64), true
 }
 
 // EnsureMigrationsTable creates the psc_migrations table if it doesn't exist.
@@ -75,8 +106,8 @@ func UpsertMigration(db *sql.DB, m *Migration) error {
 func LoadMigrations(db *sql.DB) ([]MigrationRecord, error) {
 	rows, err := db.Query(`
 		SELECT id, name, filename, status, target_service, batch_column, chunk_size, parallelism,
-		       max_id, last_completed_id, total_affected_rows, error_count, last_error,
-		       started_at, completed_at, created_at, updated_at
+		       min_id, max_id, last_completed_id, total_affected_rows, error_count, last_error,
+		       failed_chunks, started_at, completed_at, created_at, updated_at
 		FROM psc_migrations ORDER BY id`)
 	if err != nil {
 		return nil, err
@@ -87,9 +118,9 @@ func LoadMigrations(db *sql.DB) ([]MigrationRecord, error) {
 	for rows.Next() {
 		var r MigrationRecord
 		err := rows.Scan(&r.ID, &r.Name, &r.Filename, &r.Status, &r.TargetService,
-			&r.BatchColumn, &r.ChunkSize, &r.Parallelism, &r.MaxID,
+			&r.BatchColumn, &r.ChunkSize, &r.Parallelism, &r.MinID, &r.MaxID,
 			&r.LastCompletedID, &r.TotalAffected, &r.ErrorCount, &r.LastError,
-			&r.StartedAt, &r.CompletedAt, &r.CreatedAt, &r.UpdatedAt)
+			&r.FailedChunks, &r.StartedAt, &r.CompletedAt, &r.CreatedAt, &r.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -98,23 +129,43 @@ func LoadMigrations(db *sql.DB) ([]MigrationRecord, error) {
 	return records, rows.Err()
 }
 
-// UpdateStatus updates the migration status and related fields.
+// eventsChannel is the LISTEN/NOTIFY channel status transitions are published on.
+const eventsChannel = "psc_events"
+
+// UpdateStatus updates the migration status and related fields, and publishes
+// the transition on the psc_events channel.
 func UpdateStatus(db *sql.DB, name, status string) error {
 	now := time.Now()
+	var err error
 	switch status {
 	case "running":
-		_, err := db.Exec(`UPDATE psc_migrations SET status=$1, started_at=$2, updated_at=$2 WHERE name=$3`,
+		_, err = db.Exec(`UPDATE psc_migrations SET status=$1, started_at=$2, updated_at=$2 WHERE name=$3`,
 			status, now, name)
-		return err
 	case "completed":
-		_, err := db.Exec(`UPDATE psc_migrations SET status=$1, completed_at=$2, updated_at=$2 WHERE name=$3`,
+		_, err = db.Exec(`UPDATE psc_migrations SET status=$1, completed_at=$2, updated_at=$2 WHERE name=$3`,
 			status, now, name)
-		return err
 	default:
-		_, err := db.Exec(`UPDATE psc_migrations SET status=$1, updated_at=$2 WHERE name=$3`,
+		_, err = db.Exec(`UPDATE psc_migrations SET status=$1, updated_at=$2 WHERE name=$3`,
 			status, now, name)
+	}
+	if err != nil {
 		return err
 	}
+	return notifyStatus(db, name)
+}
+
+// notifyStatus sends a JSON payload describing the migration's current state
+// to listeners on eventsChannel.
+func notifyStatus(db *sql.DB, name string) error {
+	_, err := db.Exec(`
+		SELECT pg_notify($1, json_build_object(
+			'name', name,
+			'status', status,
+			'rows', total_affected_rows,
+			'chunk', last_completed_id
+		)::text)
+		FROM psc_migrations WHERE name=$2`, eventsChannel, name)
+	return err
 }
 
 // UpdateProgress updates last_completed_id and total_affected_rows.
@@ -124,9 +175,10 @@ func UpdateProgress(db *sql.DB, name string, lastID, affected int64) error {
 	return err
 }
 
-// UpdateMaxID sets the max_id for a batched migration.
-func UpdateMaxID(db *sql.DB, name string, maxID int64) error {
-	_, err := db.Exec(`UPDATE psc_migrations SET max_id=$1, updated_at=NOW() WHERE name=$2`, maxID, name)
+// UpdateIDRange sets the min_id and max_id for a batched migration.
+func UpdateIDRange(db *sql.DB, name string, minID, maxID int64) error {
+	_, err := db.Exec(`UPDATE psc_migrations SET min_id=$1, max_id=$2, updated_at=NOW() WHERE name=$3`,
+		minID, maxID, name)
 	return err
 }
 
@@ -137,18 +189,37 @@ func RecordError(db *sql.DB, name string, errMsg string) error {
 	return err
 }
 
+// UpdateFailedChunks records the batch ranges that failed and are pending retry.
+func UpdateFailedChunks(db *sql.DB, name, ranges string) error {
+	_, err := db.Exec(`UPDATE psc_migrations SET failed_chunks=NULLIF($1,''), updated_at=NOW() WHERE name=$2`,
+		ranges, name)
+	return err
+}
+
+// DeleteMigration removes a migration's state row unless it is running.
+func DeleteMigration(db *sql.DB, name string) error {
+	res, err := db.Exec(`DELETE FROM psc_migrations WHERE name=$1 AND status <> 'running'`, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("migration %q is running or no longer exists", name)
+	}
+	return nil
+}
+
 // GetMigrationByName loads a single migration record.
 func GetMigrationByName(db *sql.DB, name string) (*MigrationRecord, error) {
 	r := &MigrationRecord{}
 	err := db.QueryRow(`
 		SELECT id, name, filename, status, target_service, batch_column, chunk_size, parallelism,
-		       max_id, last_completed_id, total_affected_rows, error_count, last_error,
-		       started_at, completed_at, created_at, updated_at
+		       min_id, max_id, last_completed_id, total_affected_rows, error_count, last_error,
+		       failed_chunks, started_at, completed_at, created_at, updated_at
 		FROM psc_migrations WHERE name=$1`, name).Scan(
 		&r.ID, &r.Name, &r.Filename, &r.Status, &r.TargetService,
-		&r.BatchColumn, &r.ChunkSize, &r.Parallelism, &r.MaxID,
+		&r.BatchColumn, &r.ChunkSize, &r.Parallelism, &r.MinID, &r.MaxID,
 		&r.LastCompletedID, &r.TotalAffected, &r.ErrorCount, &r.LastError,
-		&r.StartedAt, &r.CompletedAt, &r.CreatedAt, &r.UpdatedAt)
+		&r.FailedChunks, &r.StartedAt, &r.CompletedAt, &r.CreatedAt, &r.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// runDescribe prints a table's columns, primary key, indexes, row estimate
+// and size on --service, plus the id range of an integer primary key, which
+// is what choosing a psc:batch column and chunk size needs.
+func runDescribe(opts options, table string) {
+	db, err := ConnectService(opts.service)
+	if err != nil {
+		fatal(&ConnectError{Service: opts.service, Err: err})
+	}
+	defer db.Close()
+
+	rel := quoteQualifiedIdent(table)
+	var name sql.NullString
+	if err := db.QueryRow(`SELECT to_regclass($1)::text`, rel).Scan(&name); err != nil {
+		fatal(err)
+	}
+	if !name.Valid {
+		fatal(invalidf("table %s does not exist on %s", table, opts.service))
+	}
+
+	var estimate int64
+	var total, heap, indexes string
+	err = db.QueryRow(`
+		SELECT reltuples::bigint,
+		       pg_size_pretty(pg_total_relation_size(oid)),
+		       pg_size_pretty(pg_relation_size(oid)),
+		       pg_size_pretty(pg_indexes_size(oid))
+		FROM pg_class WHERE oid = $1::regclass`, rel).Scan(&estimate, &total, &heap, &indexes)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("Table:    %s on %s\n", name.String, opts.service)
+	if estimate < 0 {
+		fmt.Println("Rows:     unknown (never analyzed)")
+	} else {
+		fmt.Printf("Rows:     ~%s (estimate)\n", FormatNumber(estimate))
+	}
+	fmt.Printf("Size:     %s total (%s table, %s indexes)\n", total, heap, indexes)
+
+	if err := describeColumns(db, rel); err != nil {
+		fatal(err)
+	}
+	pk, err := describeIndexes(db, rel)
+	if err != nil {
+		fatal(err)
+	}
+	if err := describeBatchRange(db, rel, pk, estimate); err != nil {
+		fatal(err)
+	}
+}
+
+func describeColumns(db *sql.DB, rel string) error {
+	rows, err := db.Query(`
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull,
+		       COALESCE(pg_get_expr(d.adbin, d.adrelid), '')
+		FROM pg_attribute a
+		LEFT JOIN pg_attrdef d ON d.adrelid = a.attrelid AND d.adnum = a.attnum
+		WHERE a.attrelid = $1::regclass AND a.attnum > 0 AND NOT a.attisdropped
+		ORDER BY a.attnum`, rel)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fmt.Printf("\n%-32s %-28s %-9s %s\n", "COLUMN", "TYPE", "NULL", "DEFAULT")
+	for rows.Next() {
+		var col, typ, def string
+		var notNull bool
+		if err := rows.Scan(&col, &typ, &notNull, &def); err != nil {
+			return err
+		}
+		null := "yes"
+		if notNull {
+			null = "not null"
+		}
+		fmt.Printf("%-32s %-28s %-9s %s\n", col, typ, null, def)
+	}
+	return rows.Err()
+}
+
+// pkColumn is one column of a primary key.
+type pkColumn struct {
+	Name, Type string
+}
+
+// describeIndexes prints the table's indexes and returns its primary key
+// columns in key order.
+func describeIndexes(db *sql.DB, rel string) ([]pkColumn, error) {
+	rows, err := db.Query(`
+		SELECT c.relname, pg_get_indexdef(i.indexrelid), i.indisprimary,
+		       pg_size_pretty(pg_relation_size(i.indexrelid))
+		FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indexrelid
+		WHERE i.indrelid = $1::regclass
+		ORDER BY i.indisprimary DESC, c.relname`, rel)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fmt.Printf("\n%-32s %-10s %s\n", "INDEX", "SIZE", "DEFINITION")
+	n := 0
+	for rows.Next() {
+		var idx, def, size string
+		var primary bool
+		if err := rows.Scan(&idx, &def, &primary, &size); err != nil {
+			return nil, err
+		}
+		if primary {
+			idx += " (pk)"
+		}
+		fmt.Printf("%-32s %-10s %s\n", idx, size, def)
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		fmt.Println("(none)")
+	}
+
+	pkRows, err := db.Query(`
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+		FROM pg_index i
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+		WHERE i.indrelid = $1::regclass AND i.indisprimary
+		ORDER BY array_position(i.indkey::int2[], a.attnum)`, rel)
+	if err != nil {
+		return nil, err
+	}
+	defer pkRows.Close()
+	var pk []pkColumn
+	for pkRows.Next() {
+		var c pkColumn
+		if err := pkRows.Scan(&c.Name, &c.Type); err != nil {
+			return nil, err
+		}
+		pk = append(pk, c)
+	}
+	if err := pkRows.Err(); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(pk))
+	for i, c := range pk {
+		names[i] = c.Name
+	}
+	if len(pk) == 0 {
+		fmt.Println("\nPrimary key: none")
+	} else {
+		fmt.Printf("\nPrimary key: %s\n", strings.Join(names, ", "))
+	}
+	return pk, nil
+}
+
+// describeBatchRange prints the id range of a single integer primary key,
+// the natural psc:batch column, with how many rows an id spans on average.
+func describeBatchRange(db *sql.DB, rel string, pk []pkColumn, estimate int64) error {
+	if len(pk) != 1 {
+		return nil
+	}
+	switch pk[0].Type {
+	case "smallint", "integer", "bigint":
+	default:
+		return nil
+	}
+	col := pq.QuoteIdentifier(pk[0].Name)
+	var minID, maxID sql.NullInt64
+	err := db.QueryRow(fmt.Sprintf(`SELECT MIN(%s), MAX(%s) FROM %s`, col, col, rel)).Scan(&minID, &maxID)
+	if err != nil || !minID.Valid {
+		return err
+	}
+	span := maxID.Int64 - minID.Int64 + 1
+	fmt.Printf("Batch range: %s %s..%s", pk[0].Name, FormatNumber(minID.Int64), FormatNumber(maxID.Int64))
+	if estimate > 0 {
+		fmt.Printf(" (~%.2f rows per id)", float64(estimate)/float64(span))
+	}
+	fmt.Println()
+	return nil
+}
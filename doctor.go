@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// doctor collects the results of environment checks.
+type doctor struct {
+	failures int
+	warnings int
+}
+
+func (dr *doctor) ok(format string, args ...any) {
+	fmt.Printf("  ok    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (dr *doctor) warn(hint, format string, args ...any) {
+	dr.warnings++
+	fmt.Printf("  warn  %s\n", fmt.Sprintf(format, args...))
+	if hint != "" {
+		fmt.Printf("        → %s\n", hint)
+	}
+}
+
+func (dr *doctor) fail(hint, format string, args ...any) {
+	dr.failures++
+	fmt.Printf("  FAIL  %s\n", fmt.Sprintf(format, args...))
+	if hint != "" {
+		fmt.Printf("        → %s\n", hint)
+	}
+}
+
+// runDoctor checks the service file, every service's connectivity, the state
+// table and the migrations directory, printing a fix for each problem. It
+// exits non-zero if any check failed.
+func runDoctor(opts options) {
+	dr := &doctor{}
+
+	fmt.Println("Service file")
+	services := dr.checkServiceFile()
+
+	fmt.Println("Services")
+	reachable := dr.checkServices(services)
+
+	fmt.Println("State table")
+	dr.checkStateTable(opts.service, services, reachable)
+
+	fmt.Println("Migrations")
+	dr.checkRepo(opts, services)
+
+	fmt.Println()
+	if dr.failures > 0 {
+		fmt.Printf("%d problems, %d warnings.\n", dr.failures, dr.warnings)
+		os.Exit(exitFailed)
+	}
+	fmt.Printf("No problems found (%d warnings).\n", dr.warnings)
+}
+
+func (dr *doctor) checkServiceFile() map[string]ServiceConfig {
+	path, err := ServiceFilePath()
+	if err != nil {
+		dr.fail("set HOME", "cannot locate home directory: %v", err)
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		dr.fail("create it with a [service] section per database", "%s: %v", path, err)
+		return nil
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		dr.warn(fmt.Sprintf("chmod 600 %s", path), "%s is readable by other users (%s) and may contain passwords", path, info.Mode().Perm())
+	}
+	services, err := ParseServiceFile(path)
+	if err != nil {
+		dr.fail("", "%v", err)
+		return nil
+	}
+	if len(services) == 0 {
+		dr.fail("add a [service] section per database", "%s defines no services", path)
+		return nil
+	}
+	dr.ok("%s defines %d services", path, len(services))
+	return services
+}
+
+// checkServices connects to every service, returning those that answered.
+func (dr *doctor) checkServices(services map[string]ServiceConfig) map[string]bool {
+	reachable := make(map[string]bool)
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p, err := probeService(name)
+		if err != nil {
+			cfg := services[name]
+			dr.fail("check host, port, credentials and that the server accepts connections from here",
+				"%s (%s@%s:%s/%s): %v", name, cfg.User, cfg.Host, cfg.Port, cfg.DBName, err)
+			continue
+		}
+		reachable[name] = true
+		dr.ok("%s: connected in %s (PostgreSQL %s)", name, p.Connect.Round(time.Millisecond), p.Version)
+	}
+	return reachable
+}
+
+func (dr *doctor) checkStateTable(service string, services map[string]ServiceConfig, reachable map[string]bool) {
+	switch {
+	case service == "":
+		dr.fail("pass --service <name>", "no state service given")
+		return
+	case services != nil && !hasService(services, service):
+		dr.fail("add it to pg_service.conf or pass a different --service", "service %q is not defined", service)
+		return
+	case !reachable[service]:
+		dr.fail("", "state service %q is unreachable", service)
+		return
+	}
+	db, err := ConnectService(service)
+	if err != nil {
+		dr.fail("", "%v", err)
+		return
+	}
+	defer db.Close()
+
+	var exists bool
+	if err := db.QueryRow(`SELECT to_regclass('psc_migrations') IS NOT NULL`).Scan(&exists); err != nil {
+		dr.fail("", "checking psc_migrations: %v", err)
+		return
+	}
+	if exists {
+		dr.ok("psc_migrations exists on %s", service)
+		return
+	}
+	var canCreate bool
+	err = db.QueryRow(`SELECT has_schema_privilege(current_schema(), 'CREATE')`).Scan(&canCreate)
+	if err != nil || !canCreate {
+		dr.fail("GRANT CREATE on the schema, or create psc_migrations as another role",
+			"psc_migrations does not exist on %s and the current user cannot create it", service)
+		return
+	}
+	dr.ok("psc_migrations will be created on %s on first run", service)
+}
+
+func (dr *doctor) checkRepo(opts options, services map[string]ServiceConfig) {
+	entries, err := os.ReadDir(opts.repo)
+	if err != nil {
+		dr.fail("pass --repo <migrations directory>", "%v", err)
+		return
+	}
+	files := make(map[string]string) // migration name -> first file defining it
+	parsed, failed := 0, 0
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		m, err := ParseMigrationFile(filepath.Join(opts.repo, entry.Name()), opts.env)
+		if err != nil {
+			dr.fail("", "%s: %v", entry.Name(), err)
+			failed++
+			continue
+		}
+		if prev, ok := files[m.Name]; ok {
+			dr.fail("give each migration a unique psc:migrate name", "%s and %s both define migration %q", prev, entry.Name(), m.Name)
+			failed++
+			continue
+		}
+		files[m.Name] = entry.Name()
+		if m.Service != "" && services != nil && !hasService(services, m.Service) {
+			dr.fail("add it to pg_service.conf or fix psc:target", "%s targets undefined service %q", entry.Name(), m.Service)
+			failed++
+			continue
+		}
+		parsed++
+	}
+	switch {
+	case parsed+failed == 0:
+		dr.warn("pass --repo <migrations directory>", "no .sql files in %s", opts.repo)
+	case failed == 0:
+		dr.ok("%d migrations in %s parse cleanly", parsed, opts.repo)
+	}
+}
+
+func hasService(services map[string]ServiceConfig, name string) bool {
+	_, ok := services[name]
+	return ok
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event is one line of machine-readable CLI output.
+type Event struct {
+	Event         string    `json:"event"` // start, progress, chunk, error, skipped, completed, failed, cancelled
+	Time          time.Time `json:"time"`
+	Name          string    `json:"name"`
+	Service       string    `json:"service,omitempty"`
+	Table         string    `json:"table,omitempty"`
+	Phase         string    `json:"phase,omitempty"`
+	ChunkStart    *int64    `json:"chunk_start,omitempty"`
+	ChunkEnd      *int64    `json:"chunk_end,omitempty"`
+	Rows          *int64    `json:"rows,omitempty"`
+	LastID        *int64    `json:"last_id,omitempty"`
+	MaxID         *int64    `json:"max_id,omitempty"`
+	Percent       *float64  `json:"percent,omitempty"`
+	TotalAffected int64     `json:"total_affected"`
+	RowsPerSec    int64     `json:"rows_per_sec,omitempty"`
+	ETASeconds    *int64    `json:"eta_seconds,omitempty"`
+	Paused        bool      `json:"paused,omitempty"`
+	ErrorCount    int       `json:"error_count,omitempty"`
+	FailedChunks  string    `json:"failed_chunks,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// EventStream writes events as newline-delimited JSON. It is safe for
+// concurrent use, since chunk events arrive from every worker.
+type EventStream struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewEventStream creates an EventStream writing to w.
+func NewEventStream(w io.Writer) *EventStream {
+	return &EventStream{enc: json.NewEncoder(w)}
+}
+
+// Emit writes ev, stamping it with the current time. A nil stream discards
+// events.
+func (s *EventStream) Emit(ev Event) {
+	if s == nil {
+		return
+	}
+	ev.Time = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_ = s.enc.Encode(ev)
+}
+
+// HookEvent forwards executor lifecycle events that have no other CLI
+// output: finished chunks and errors.
+func (s *EventStream) HookEvent(p HookPayload) {
+	switch p.Event {
+	case hookAfterChunk:
+		rows := p.Rows
+		s.Emit(Event{Event: "chunk", Name: p.Name, Service: p.Service, ChunkStart: p.ChunkStart,
+			ChunkEnd: p.ChunkEnd, Rows: &rows, TotalAffected: p.TotalAffected})
+	case hookOnError:
+		s.Emit(Event{Event: "error", Name: p.Name, Service: p.Service, ChunkStart: p.ChunkStart,
+			ChunkEnd: p.ChunkEnd, Error: p.Error})
+	}
+}
+
+// progressEvent snapshots a running migration.
+func progressEvent(m *Migration, es *ExecutionState) Event {
+	ev := Event{
+		Event:         "progress",
+		Name:          es.Name,
+		Service:       m.Service,
+		Table:         migrationTable(m),
+		Phase:         es.Phase(),
+		TotalAffected: es.TotalAffected.Load(),
+		RowsPerSec:    es.Rate.Load(),
+		Paused:        es.Paused.Load(),
+	}
+	if minID, maxID, ok := es.IDRange(); ok {
+		lastID := es.LastCompletedID.Load()
+		pct := rangeProgress(lastID, minID, maxID)
+		ev.LastID, ev.MaxID, ev.Percent = &lastID, &maxID, &pct
+	}
+	if eta, ok := es.ETA(); ok {
+		sec := int64(eta.Seconds())
+		ev.ETASeconds = &sec
+	}
+	return ev
+}
+
+// migrationTable returns the table a migration writes to, or "" if it can't
+// be determined from the SQL.
+func migrationTable(m *Migration) string {
+	if t := extractTableForMax(m.SQL); t != "unknown_table" {
+		return t
+	}
+	return ""
+}
+
+// streamProgress emits a progress event for every running migration each
+// interval until stop is closed. It backs --progress-file in daemon mode.
+func streamProgress(d *Daemon, events *EventStream, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, name := range d.Executor.RunningNames() {
+			es, m := d.Executor.GetState(name), d.GetMigration(name)
+			if es == nil || m == nil {
+				continue
+			}
+			events.Emit(progressEvent(m, es))
+		}
+	}
+}
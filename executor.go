@@ -3,11 +3,19 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 // ExecutionState tracks a running migration for the TUI.
@@ -17,17 +25,145 @@ type ExecutionState struct {
 	StartedAt       time.Time
 	TotalAffected   atomic.Int64
 	LastCompletedID atomic.Int64
-	MaxID           int64
-	Rate            atomic.Int64 // rows/sec rolling estimate
+	Rate            atomic.Int64  // rows/sec rolling estimate
+	Paused          atomic.Bool   // waiting for replica lag to recover
+	phase           atomic.Value  // string; non-empty during post-run maintenance
+	ReplicaLag      atomic.Int64  // last observed lag, as a time.Duration
+	drained         chan struct{} // closed to stop claiming chunks; in-flight ones finish
+	drainOnce       sync.Once
+
+	// The planned id range of a batched migration, published by planned.
+	minID, maxID int64
+	planned      atomic.Bool
+
+	etaMu      sync.Mutex
+	idRate     float64 // EMA of ids/sec processed
+	sampleAt   time.Time
+	sampledIDs int64 // ids processed since sampleAt
+}
+
+// drain stops the migration claiming new chunks and wakes any throttle waits.
+func (es *ExecutionState) drain() {
+	es.drainOnce.Do(func() { close(es.drained) })
+}
+
+// draining reports whether drain has been called.
+func (es *ExecutionState) draining() bool {
+	select {
+	case <-es.drained:
+		return true
+	default:
+		return false
+	}
+}
+
+// setIDRange publishes the id range a batched migration will process.
+func (es *ExecutionState) setIDRange(minID, maxID int64) {
+	es.minID, es.maxID = minID, maxID
+	es.planned.Store(true)
+}
+
+// IDRange returns the planned id range, or false until it is known.
+func (es *ExecutionState) IDRange() (minID, maxID int64, ok bool) {
+	if !es.planned.Load() {
+		return 0, 0, false
+	}
+	return es.minID, es.maxID, true
+}
+
+// SetPhase records the post-run phase currently executing ("" when none).
+func (es *ExecutionState) SetPhase(phase string) {
+	es.phase.Store(phase)
+}
+
+// Phase returns the post-run phase currently executing, if any.
+func (es *ExecutionState) Phase() string {
+	phase, _ := es.phase.Load().(string)
+	return phase
+}
+
+// etaAlpha is the smoothing factor for the ids/sec moving average.
+const etaAlpha = 0.3
+
+// observeIDs records that n ids of the batch range were processed and folds
+// them into the moving average once at least a second has elapsed.
+func (es *ExecutionState) observeIDs(n int64) {
+	es.etaMu.Lock()
+	defer es.etaMu.Unlock()
+	now := time.Now()
+	if es.sampleAt.IsZero() {
+		es.sampleAt = es.StartedAt
+	}
+	es.sampledIDs += n
+	elapsed := now.Sub(es.sampleAt).Seconds()
+	if elapsed < 1 {
+		return
+	}
+	rate := float64(es.sampledIDs) / elapsed
+	if es.idRate == 0 {
+		es.idRate = rate
+	} else {
+		es.idRate = etaAlpha*rate + (1-etaAlpha)*es.idRate
+	}
+	es.sampleAt = now
+	es.sampledIDs = 0
+}
+
+// ETA returns the estimated time remaining for a batched migration, or false
+// if there is not enough data yet.
+func (es *ExecutionState) ETA() (time.Duration, bool) {
+	es.etaMu.Lock()
+	rate := es.idRate
+	es.etaMu.Unlock()
+	minID, maxID, ok := es.IDRange()
+	if rate <= 0 || !ok {
+		return 0, false
+	}
+	remaining := maxID - max(es.LastCompletedID.Load(), minID)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Duration(float64(remaining) / rate * float64(time.Second)), true
+}
+
+// FormatETA renders a remaining duration for display.
+func FormatETA(d time.Duration) string {
+	sec := int64(d.Seconds())
+	switch {
+	case sec > 3600:
+		return fmt.Sprintf("%dh %dm", sec/3600, (sec%3600)/60)
+	case sec > 60:
+		return fmt.Sprintf("%dm %ds", sec/60, sec%60)
+	default:
+		return fmt.Sprintf("%ds", sec)
+	}
 }
 
 // Executor runs migrations against the database.
 type Executor struct {
 	stateDB        *sql.DB
 	defaultService string
+	metrics        *Metrics
+	logf           func(format string, args ...any)
 
-	mu       sync.Mutex
-	running  map[string]*ExecutionState
+	// Logger receives structured run, chunk and SQL logs. It discards
+	// everything unless the caller configures it.
+	Logger *slog.Logger
+
+	// Hooks are external commands run on lifecycle events.
+	Hooks Hooks
+
+	// OnEvent, if set, is called in-process for every lifecycle event
+	// alongside Hooks.
+	OnEvent func(HookPayload)
+
+	// DefaultSettings are session settings applied to every migration's
+	// connections before the migration's own psc:set values.
+	DefaultSettings map[string]string
+
+	mu      sync.Mutex
+	running map[string]*ExecutionState
+	stops   map[string]string // "drain" or "cancel" requested before Run registered state
 }
 
 // NewExecutor creates a new Executor.
@@ -35,7 +171,12 @@ func NewExecutor(stateDB *sql.DB, defaultService string) *Executor {
 	return &Executor{
 		stateDB:        stateDB,
 		defaultService: defaultService,
+		metrics:        NewMetrics(),
+		logf:           func(string, ...any) {},
+		Logger:         slog.New(slog.DiscardHandler),
+		Hooks:          Hooks{},
 		running:        make(map[string]*ExecutionState),
+		stops:          make(map[string]string),
 	}
 }
 
@@ -47,6 +188,18 @@ func (e *Executor) IsRunning(name string) bool {
 	return ok
 }
 
+// RunningNames returns the names of all currently executing migrations.
+func (e *Executor) RunningNames() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	names := make([]string, 0, len(e.running))
+	for name := range e.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // GetState returns the execution state for a running migration.
 func (e *Executor) GetState(name string) *ExecutionState {
 	e.mu.Lock()
@@ -54,10 +207,30 @@ func (e *Executor) GetState(name string) *ExecutionState {
 	return e.running[name]
 }
 
-// Cancel cancels a running migration.
+// Drain asks a batched migration to stop claiming new chunks and return once
+// its in-flight chunks finish, checkpointing the highest id below which every
+// chunk is done. It has no effect on non-batched migrations. A request made
+// while Run is still connecting or locking applies as soon as it starts.
+func (e *Executor) Drain(name string) {
+	e.mu.Lock()
+	es, ok := e.running[name]
+	if !ok && e.stops[name] == "" {
+		e.stops[name] = "drain"
+	}
+	e.mu.Unlock()
+	if ok {
+		es.drain()
+	}
+}
+
+// Cancel cancels a migration. Like Drain, a request made before Run has
+// registered the migration applies once it does.
 func (e *Executor) Cancel(name string) {
 	e.mu.Lock()
 	es, ok := e.running[name]
+	if !ok {
+		e.stops[name] = "cancel"
+	}
 	e.mu.Unlock()
 	if ok {
 		es.Cancel()
@@ -76,38 +249,123 @@ func (e *Executor) Run(m *Migration, record *MigrationRecord) error {
 
 	targetDB, err := ConnectService(service)
 	if err != nil {
-		return fmt.Errorf("connecting to %s: %w", service, err)
+		return &ConnectError{Service: service, Err: err}
 	}
 	defer targetDB.Close()
 
+	lock, err := acquireMigrationLock(targetDB, m.Name)
+	if err != nil {
+		return err
+	}
+	defer releaseMigrationLock(lock, m.Name)
+
+	before := HookPayload{Event: hookBeforeRun, Name: m.Name, Service: service}
+	if e.OnEvent != nil {
+		e.OnEvent(before)
+	}
+	if err := e.Hooks.Run(before); err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	es := &ExecutionState{
 		Name:      m.Name,
 		Cancel:    cancel,
 		StartedAt: time.Now(),
+		drained:   make(chan struct{}),
 	}
 	es.TotalAffected.Store(record.TotalAffected)
 	es.LastCompletedID.Store(record.LastCompletedID)
 
 	e.mu.Lock()
 	e.running[m.Name] = es
+	stop := e.stops[m.Name]
+	delete(e.stops, m.Name)
 	e.mu.Unlock()
 
 	defer func() {
 		cancel()
 		e.mu.Lock()
 		delete(e.running, m.Name)
+		delete(e.stops, m.Name)
 		e.mu.Unlock()
 	}()
 
+	// A stop requested while connecting, locking or running before_run ends
+	// the run before any work, leaving the recorded status as it was. A drain
+	// only applies to batched migrations; a single statement runs to the end.
+	if stop == "cancel" || (stop == "drain" && m.IsBatched()) {
+		e.fireHook(HookPayload{Event: hookAfterRun, Name: m.Name, Service: service, Status: "cancelled",
+			TotalAffected: record.TotalAffected})
+		return fmt.Errorf("stopped before start: %w", context.Canceled)
+	}
+
 	if err := UpdateStatus(e.stateDB, m.Name, "running"); err != nil {
 		return err
 	}
+	log := e.Logger.With("migration", m.Name, "service", service)
+	log.Info("migration started", "batched", m.IsBatched())
 
 	if m.IsBatched() {
-		return e.runBatched(ctx, m, record, targetDB, es)
+		err = e.runBatched(ctx, m, record, targetDB, es)
+	} else {
+		err = e.runSingle(ctx, m, targetDB, es)
+	}
+	if err == nil {
+		e.runAfter(ctx, m, targetDB, es)
+		_ = UpdateStatus(e.stateDB, m.Name, "completed")
+	}
+
+	status := "completed"
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) {
+		status = "cancelled"
+	} else if err != nil {
+		status = "failed"
+	}
+	log.Info("migration finished", "status", status, "total_affected", es.TotalAffected.Load(),
+		"elapsed", time.Since(es.StartedAt).Round(time.Millisecond))
+	e.fireHook(HookPayload{Event: hookAfterRun, Name: m.Name, Service: service, Status: status,
+		TotalAffected: es.TotalAffected.Load()})
+	return err
+}
+
+// runAfter runs the migration's post-run maintenance (psc:after) as a final
+// phase. Failures are recorded but don't fail the migration.
+func (e *Executor) runAfter(ctx context.Context, m *Migration, targetDB *sql.DB, es *ExecutionState) {
+	var stmt string
+	table := quoteQualifiedIdent(extractTableForMax(m.SQL))
+	switch m.After {
+	case "analyze":
+		stmt = "ANALYZE " + table
+	case "vacuum":
+		stmt = "VACUUM (ANALYZE) " + table
+	default:
+		return
+	}
+	es.SetPhase(m.After)
+	defer es.SetPhase("")
+	// psc:timeout bounds chunks, not maintenance: a VACUUM of the whole table
+	// would routinely exceed it.
+	conn, err := openSession(ctx, targetDB, map[string]string{"statement_timeout": "0"})
+	if err == nil {
+		defer closeSession(conn)
+		_, err = conn.ExecContext(ctx, stmt)
+	}
+	if err != nil {
+		_ = RecordError(e.stateDB, m.Name, fmt.Sprintf("%s: %s", m.After, err.Error()))
+		e.fireHook(HookPayload{Event: hookOnError, Name: m.Name, Service: m.Service, Error: err.Error()})
+	}
+}
+
+// fireHook reports a non-blocking event to OnEvent and runs its hooks,
+// logging any failure.
+func (e *Executor) fireHook(p HookPayload) {
+	if e.OnEvent != nil {
+		e.OnEvent(p)
+	}
+	if err := e.Hooks.Run(p); err != nil {
+		e.logf("%s: %v", p.Name, err)
 	}
-	return e.runSingle(ctx, m, targetDB, es)
 }
 
 func (e *Executor) runSingle(ctx context.Context, m *Migration, targetDB *sql.DB, es *ExecutionState) error {
@@ -120,44 +378,64 @@ func (e *Executor) runSingle(ctx context.Context, m *Migration, targetDB *sql.DB
 	}
 	defer execCancel()
 
-	result, err := targetDB.ExecContext(execCtx, m.SQL)
+	conn, err := openSession(ctx, targetDB, e.sessionSettings(m))
+	if err != nil {
+		_ = RecordError(e.stateDB, m.Name, err.Error())
+		_ = UpdateStatus(e.stateDB, m.Name, "failed")
+		e.fireHook(HookPayload{Event: hookOnError, Name: m.Name, Service: m.Service, Error: err.Error()})
+		return err
+	}
+	defer closeSession(conn)
+
+	e.Logger.Debug("executing statement", "migration", m.Name, "sql", m.SQL)
+	execStart := time.Now()
+	result, err := conn.ExecContext(execCtx, m.SQL)
+	e.metrics.ObserveChunk(m.Name, time.Since(execStart), err)
 	if err != nil {
+		e.Logger.Error("statement failed", "migration", m.Name, "error", err)
 		_ = RecordError(e.stateDB, m.Name, err.Error())
 		_ = UpdateStatus(e.stateDB, m.Name, "failed")
+		e.fireHook(HookPayload{Event: hookOnError, Name: m.Name, Service: m.Service, Error: err.Error()})
 		return err
 	}
 
 	affected, _ := result.RowsAffected()
 	es.TotalAffected.Store(affected)
 	_ = UpdateProgress(e.stateDB, m.Name, 0, affected)
-	_ = UpdateStatus(e.stateDB, m.Name, "completed")
 	return nil
 }
 
 func (e *Executor) runBatched(ctx context.Context, m *Migration, record *MigrationRecord, targetDB *sql.DB, es *ExecutionState) error {
-	// Get max ID
-	var maxID int64
-	row := targetDB.QueryRowContext(ctx, fmt.Sprintf("SELECT COALESCE(MAX(%s), 0) FROM (%s) AS _psc_sub",
-		m.BatchColumn, stripWhereClause(m.SQL)))
-	// Simpler: query the table directly. We need to extract table name or just use a simpler approach.
-	// Actually, let's query max from the batch column directly.
-	// We need the table name from the SQL. For simplicity, query it raw.
-	row = targetDB.QueryRowContext(ctx, fmt.Sprintf("SELECT COALESCE(MAX(%s), 0) FROM %s",
-		m.BatchColumn, extractTableForMax(m.SQL, m.BatchColumn)))
-	if err := row.Scan(&maxID); err != nil {
-		_ = RecordError(e.stateDB, m.Name, "failed to get max id: "+err.Error())
+	if err := checkBatchTarget(ctx, targetDB, m); err != nil {
+		_ = RecordError(e.stateDB, m.Name, err.Error())
 		_ = UpdateStatus(e.stateDB, m.Name, "failed")
+		e.fireHook(HookPayload{Event: hookOnError, Name: m.Name, Service: m.Service, Error: err.Error()})
 		return err
 	}
 
-	es.MaxID = maxID
-	_ = UpdateMaxID(e.stateDB, m.Name, maxID)
-
-	startFrom := record.LastCompletedID
-	if startFrom < 0 {
-		startFrom = 0
+	// Plan against the real id range rather than assuming it starts at 0.
+	var minID, maxID int64
+	row := targetDB.QueryRowContext(ctx, idRangeQuery(m))
+	if err := row.Scan(&minID, &maxID); err != nil {
+		_ = RecordError(e.stateDB, m.Name, "failed to get id range: "+err.Error())
+		_ = UpdateStatus(e.stateDB, m.Name, "failed")
+		e.fireHook(HookPayload{Event: hookOnError, Name: m.Name, Service: m.Service,
+			Error: "failed to get id range: " + err.Error()})
+		return err
 	}
 
+	es.setIDRange(minID, maxID)
+	_ = UpdateIDRange(e.stateDB, m.Name, minID, maxID)
+
+	startFrom := resumeStart(record, minID)
+	cp := newCheckpoint(startFrom - 1)
+	// Seed the checkpoint so a run stopped before its first chunk finishes
+	// still resumes from minID; see HasCheckpoint.
+	es.LastCompletedID.Store(startFrom - 1)
+	_ = UpdateProgress(e.stateDB, m.Name, startFrom-1, record.TotalAffected)
+	e.Logger.Info("planned id range", "migration", m.Name, "min_id", minID, "max_id", maxID,
+		"resume_from", startFrom, "chunk_size", m.ChunkSize, "parallelism", m.Parallelism)
+
 	var counter atomic.Int64
 	counter.Store(startFrom)
 
@@ -168,25 +446,80 @@ func (e *Executor) runBatched(ctx context.Context, m *Migration, record *Migrati
 	}
 
 	var wg sync.WaitGroup
-	var firstErr atomic.Value
+	var cancelOnce sync.Once
 	var totalAffected atomic.Int64
 	totalAffected.Store(record.TotalAffected)
 
+	var errMu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		errMu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		errMu.Unlock()
+		_ = UpdateStatus(e.stateDB, m.Name, "failed")
+	}
+	failed := func() error {
+		errMu.Lock()
+		defer errMu.Unlock()
+		return firstErr
+	}
+
+	// Failed chunks from this or a previous run, retried once at the end.
+	// Saved ranges from startFrom on are rerun by the main loop instead.
+	var deadMu sync.Mutex
+	saved := parseChunkRanges(record.FailedChunks.String)
+	dead := retryBefore(saved, startFrom)
+	if !slices.Equal(dead, saved) {
+		_ = UpdateFailedChunks(e.stateDB, m.Name, formatChunkRanges(dead))
+	}
+	addDead := func(r chunkRange) {
+		deadMu.Lock()
+		if slices.Contains(dead, r) {
+			deadMu.Unlock()
+			return
+		}
+		dead = append(dead, r)
+		ranges := formatChunkRanges(dead)
+		deadMu.Unlock()
+		_ = UpdateFailedChunks(e.stateDB, m.Name, ranges)
+	}
+
 	rateStart := time.Now()
+	limiter := newRateLimiter(m.MaxRowsPerSec)
+	lag := newLagGate(targetDB, m.MaxReplicaLag, es, func(msg string) {
+		e.logf("%s: %s", m.Name, msg)
+	})
 
 	for i := 0; i < parallelism; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
+
+			conn, err := openSession(ctx, targetDB, e.sessionSettings(m))
+			if err != nil {
+				_ = RecordError(e.stateDB, m.Name, err.Error())
+				e.fireHook(HookPayload{Event: hookOnError, Name: m.Name, Service: m.Service, Error: err.Error()})
+				fail(err)
+				return
+			}
+			defer closeSession(conn)
+
 			for {
 				select {
 				case <-ctx.Done():
-					if firstErr.Load() == nil {
-						_ = UpdateStatus(e.stateDB, m.Name, "cancelled")
+					if failed() == nil {
+						cancelOnce.Do(func() {
+							_ = UpdateStatus(e.stateDB, m.Name, "cancelled")
+						})
 					}
 					return
 				default:
 				}
+				if es.draining() {
+					return
+				}
 
 				start := counter.Add(chunkSize) - chunkSize
 				if start > maxID {
@@ -197,42 +530,83 @@ func (e *Executor) runBatched(ctx context.Context, m *Migration, record *Migrati
 					end = maxID
 				}
 
-				chunkSQL := strings.ReplaceAll(m.SQL, ":start", fmt.Sprintf("%d", start))
-				chunkSQL = strings.ReplaceAll(chunkSQL, ":end", fmt.Sprintf("%d", end))
-
-				var execCtx context.Context
-				var execCancel context.CancelFunc
-				if m.Timeout > 0 {
-					execCtx, execCancel = context.WithTimeout(ctx, m.Timeout)
-				} else {
-					execCtx, execCancel = context.WithCancel(ctx)
+				if err := lag.Wait(ctx); err != nil {
+					if ctx.Err() != nil {
+						continue
+					}
+					if errors.Is(err, errDraining) {
+						// The claimed chunk is past the checkpoint, so a resume redoes it.
+						return
+					}
+					_ = RecordError(e.stateDB, m.Name, err.Error())
+					e.fireHook(HookPayload{Event: hookOnError, Name: m.Name, Service: m.Service, Error: err.Error()})
+					fail(err)
+					return
 				}
 
-				result, err := targetDB.ExecContext(execCtx, chunkSQL)
-				execCancel()
+				if m.SkipGaps {
+					next, ok, err := nextBatchID(ctx, conn, m, start)
+					if err != nil {
+						if ctx.Err() != nil {
+							continue
+						}
+						_ = RecordError(e.stateDB, m.Name, "probing next id: "+err.Error())
+						fail(err)
+						return
+					}
+					if !ok {
+						next = maxID + 1
+					}
+					if next > end {
+						// Empty range: move the shared counter past the gap.
+						for {
+							cur := counter.Load()
+							if cur >= next || counter.CompareAndSwap(cur, next) {
+								break
+							}
+						}
+						mark := cp.done(start, next-1)
+						es.LastCompletedID.Store(mark)
+						es.observeIDs(next - start)
+						_ = UpdateProgress(e.stateDB, m.Name, mark, totalAffected.Load())
+						continue
+					}
+				}
 
+				rows, err := e.execChunk(ctx, conn, m, start, end)
 				if err != nil {
 					errMsg := fmt.Sprintf("chunk %d-%d: %s", start, end, err.Error())
 					_ = RecordError(e.stateDB, m.Name, errMsg)
+					e.fireHook(HookPayload{Event: hookOnError, Name: m.Name, Service: m.Service,
+						ChunkStart: &start, ChunkEnd: &end, Error: err.Error()})
 					if m.OnError == "continue" {
+						if ctx.Err() == nil {
+							// Tracked in failed_chunks, so the checkpoint can pass it.
+							addDead(chunkRange{Start: start, End: end})
+							es.LastCompletedID.Store(cp.done(start, end))
+						}
 						continue
 					}
-					firstErr.Store(err)
-					_ = UpdateStatus(e.stateDB, m.Name, "failed")
+					fail(err)
 					return
 				}
 
-				rows, _ := result.RowsAffected()
 				newTotal := totalAffected.Add(rows)
+				mark := cp.done(start, end)
 				es.TotalAffected.Store(newTotal)
-				es.LastCompletedID.Store(end)
+				es.LastCompletedID.Store(mark)
+				es.observeIDs(end - start + 1)
 
 				elapsed := time.Since(rateStart).Seconds()
 				if elapsed > 0 {
 					es.Rate.Store(int64(float64(newTotal-record.TotalAffected) / elapsed))
 				}
 
-				_ = UpdateProgress(e.stateDB, m.Name, end, newTotal)
+				_ = UpdateProgress(e.stateDB, m.Name, mark, newTotal)
+				e.fireHook(HookPayload{Event: hookAfterChunk, Name: m.Name, Service: m.Service,
+					ChunkStart: &start, ChunkEnd: &end, Rows: rows, TotalAffected: newTotal})
+
+				_ = limiter.Wait(ctx, rows, es.drained)
 			}
 		}()
 	}
@@ -242,36 +616,418 @@ func (e *Executor) runBatched(ctx context.Context, m *Migration, record *Migrati
 	if ctx.Err() != nil {
 		return ctx.Err()
 	}
-	if v := firstErr.Load(); v != nil {
-		return v.(error)
+	if err := failed(); err != nil {
+		return err
+	}
+	if es.draining() && cp.mark() < maxID {
+		mark := cp.mark()
+		_ = UpdateProgress(e.stateDB, m.Name, mark, totalAffected.Load())
+		_ = UpdateStatus(e.stateDB, m.Name, "cancelled")
+		return fmt.Errorf("stopped after id %d: %w", mark, context.Canceled)
+	}
+
+	if len(dead) > 0 && !es.draining() {
+		if err := e.retryFailedChunks(ctx, m, targetDB, dead, &totalAffected, es); err != nil {
+			return err
+		}
 	}
 
-	_ = UpdateStatus(e.stateDB, m.Name, "completed")
 	return nil
 }
 
+// resumeStart returns the first id a batched run of r processes. Every id up
+// to a checkpoint is done, so a resume starts just past it; a run without one
+// starts at the table's minimum id.
+func resumeStart(r *MigrationRecord, minID int64) int64 {
+	if r.HasCheckpoint() {
+		return max(r.LastCompletedID+1, minID)
+	}
+	return minID
+}
+
+// checkpoint tracks the highest id below which every claimed chunk has
+// finished. Parallel workers complete chunks out of order, so the last chunk
+// to finish is not a safe place to resume from.
+type checkpoint struct {
+	mu       sync.Mutex
+	last     int64           // every id <= last is done
+	finished map[int64]int64 // chunks done above last: start -> end
+}
+
+func newCheckpoint(last int64) *checkpoint {
+	return &checkpoint{last: last, finished: make(map[int64]int64)}
+}
+
+// done records that ids start..end are finished and returns the new mark.
+// Ranges may overlap when skip_gaps jumps the shared counter past other
+// workers' claims.
+func (c *checkpoint) done(start, end int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if prev, ok := c.finished[start]; !ok || end > prev {
+		c.finished[start] = end
+	}
+	for advanced := true; advanced; {
+		advanced = false
+		for s, e := range c.finished {
+			if s > c.last+1 {
+				continue
+			}
+			delete(c.finished, s)
+			c.last = max(c.last, e)
+			advanced = true
+		}
+	}
+	return c.last
+}
+
+// mark returns the highest id below which everything is done.
+func (c *checkpoint) mark() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// retryFailedChunks makes a final sequential pass over chunks that failed
+// during the run, persisting whichever ranges still fail.
+func (e *Executor) retryFailedChunks(ctx context.Context, m *Migration, targetDB *sql.DB, dead []chunkRange, totalAffected *atomic.Int64, es *ExecutionState) error {
+	conn, err := openSession(ctx, targetDB, e.sessionSettings(m))
+	if err != nil {
+		return err
+	}
+	defer closeSession(conn)
+
+	var remaining []chunkRange
+	for _, r := range dead {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rows, err := e.execChunk(ctx, conn, m, r.Start, r.End)
+		if err != nil {
+			start, end := r.Start, r.End
+			_ = RecordError(e.stateDB, m.Name, fmt.Sprintf("retry chunk %d-%d: %s", start, end, err.Error()))
+			e.fireHook(HookPayload{Event: hookOnError, Name: m.Name, Service: m.Service,
+				ChunkStart: &start, ChunkEnd: &end, Error: err.Error()})
+			remaining = append(remaining, r)
+			continue
+		}
+		newTotal := totalAffected.Add(rows)
+		es.TotalAffected.Store(newTotal)
+		_ = UpdateProgress(e.stateDB, m.Name, es.LastCompletedID.Load(), newTotal)
+	}
+
+	if err := UpdateFailedChunks(e.stateDB, m.Name, formatChunkRanges(remaining)); err != nil {
+		return err
+	}
+	if len(remaining) > 0 {
+		_ = RecordError(e.stateDB, m.Name, fmt.Sprintf("%d chunks still failing after retry: %s",
+			len(remaining), formatChunkRanges(remaining)))
+	}
+	return nil
+}
+
+// execChunk runs one chunk of a batched migration and returns rows affected.
+// Chunks that hit the statement timeout are retried up to m.TimeoutRetries times.
+func (e *Executor) execChunk(ctx context.Context, conn *sql.Conn, m *Migration, start, end int64) (int64, error) {
+	for attempt := 0; ; attempt++ {
+		rows, err := e.execChunkOnce(ctx, conn, m, start, end)
+		if err == nil || ctx.Err() != nil || !isTimeout(err) || attempt >= m.TimeoutRetries {
+			return rows, err
+		}
+		e.logf("%s: chunk %d-%d timed out, retrying (%d/%d)", m.Name, start, end, attempt+1, m.TimeoutRetries)
+	}
+}
+
+func (e *Executor) execChunkOnce(ctx context.Context, conn *sql.Conn, m *Migration, start, end int64) (int64, error) {
+	var execCtx context.Context
+	var execCancel context.CancelFunc
+	if m.Timeout > 0 {
+		execCtx, execCancel = context.WithTimeout(ctx, m.Timeout)
+	} else {
+		execCtx, execCancel = context.WithCancel(ctx)
+	}
+	defer execCancel()
+
+	query := expandChunkSQL(m.SQL, start, end)
+	log := e.Logger.With("migration", m.Name, "start", start, "end", end)
+	log.Debug("executing chunk", "sql", query)
+	execStart := time.Now()
+	result, err := conn.ExecContext(execCtx, query)
+	elapsed := time.Since(execStart)
+	e.metrics.ObserveChunk(m.Name, elapsed, err)
+	if err != nil {
+		log.Warn("chunk failed", "elapsed", elapsed.Round(time.Millisecond), "error", err)
+		return 0, err
+	}
+	rows, _ := result.RowsAffected()
+	log.Debug("chunk done", "rows", rows, "elapsed", elapsed.Round(time.Millisecond))
+	return rows, nil
+}
+
+// isTimeout reports whether err is a statement timeout, either server-side
+// (query_canceled) or from the per-chunk context deadline.
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "57014"
+}
+
+// chunkRange is an inclusive range of batch ids.
+type chunkRange struct {
+	Start, End int64
+}
+
+// formatChunkRanges renders ranges as "start-end,start-end".
+func formatChunkRanges(ranges []chunkRange) string {
+	parts := make([]string, len(ranges))
+	for i, r := range ranges {
+		parts[i] = fmt.Sprintf("%d-%d", r.Start, r.End)
+	}
+	return strings.Join(parts, ",")
+}
+
+// retryBefore returns the parts of ranges below startFrom, which a run
+// starting there would not otherwise reach.
+func retryBefore(ranges []chunkRange, startFrom int64) []chunkRange {
+	var out []chunkRange
+	for _, r := range ranges {
+		if r.Start >= startFrom {
+			continue
+		}
+		out = append(out, chunkRange{Start: r.Start, End: min(r.End, startFrom-1)})
+	}
+	return out
+}
+
+// parseChunkRanges parses the output of formatChunkRanges, skipping malformed
+// entries. Either id may be negative, as in "-100--91".
+func parseChunkRanges(s string) []chunkRange {
+	var ranges []chunkRange
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		// The separator is the first '-' that isn't the start's sign.
+		sep := strings.Index(part[1:], "-") + 1
+		if sep == 0 {
+			continue
+		}
+		startStr, endStr := part[:sep], part[sep+1:]
+		start, err1 := strconv.ParseInt(startStr, 10, 64)
+		end, err2 := strconv.ParseInt(endStr, 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		ranges = append(ranges, chunkRange{Start: start, End: end})
+	}
+	return ranges
+}
+
+// sessionSettings merges the executor defaults with the migration's settings,
+// letting the migration win.
+func (e *Executor) sessionSettings(m *Migration) map[string]string {
+	settings := make(map[string]string, len(e.DefaultSettings)+len(m.Settings))
+	for name, value := range e.DefaultSettings {
+		settings[name] = value
+	}
+	if m.Timeout > 0 {
+		settings["statement_timeout"] = fmt.Sprintf("%d", m.Timeout.Milliseconds())
+	}
+	for name, value := range m.Settings {
+		settings[name] = value
+	}
+	return settings
+}
+
+// openSession checks out a dedicated target connection and applies the
+// migration's session settings to it.
+func openSession(ctx context.Context, db *sql.DB, settings map[string]string) (*sql.Conn, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("opening session: %w", err)
+	}
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := conn.ExecContext(ctx, "SELECT set_config($1, $2, false)", name, settings[name]); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("setting %s=%s: %w", name, settings[name], err)
+		}
+	}
+	return conn, nil
+}
+
+// closeSession resets a session opened by openSession before returning it to
+// the pool, so its settings (notably statement_timeout) don't leak into
+// whatever uses the connection next.
+func closeSession(conn *sql.Conn) {
+	_, _ = conn.ExecContext(context.Background(), "RESET ALL")
+	conn.Close()
+}
+
+// acquireMigrationLock takes a session-level advisory lock on the target keyed
+// by the migration name, so no two runners can execute the same migration.
+// The returned connection holds the lock until released.
+func acquireMigrationLock(db *sql.DB, name string) (*sql.Conn, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("acquiring lock connection: %w", err)
+	}
+	var locked bool
+	err = conn.QueryRowContext(context.Background(),
+		"SELECT pg_try_advisory_lock(hashtext('psc:' || $1))", name).Scan(&locked)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("acquiring lock for %s: %w", name, err)
+	}
+	if !locked {
+		conn.Close()
+		return nil, fmt.Errorf("migration %q is locked by another runner", name)
+	}
+	return conn, nil
+}
+
+func releaseMigrationLock(conn *sql.Conn, name string) {
+	_, _ = conn.ExecContext(context.Background(),
+		"SELECT pg_advisory_unlock(hashtext('psc:' || $1))", name)
+	conn.Close()
+}
+
+// idRangeQuery returns the query used to find the id range of a batched migration.
+func idRangeQuery(m *Migration) string {
+	column := quoteQualifiedIdent(m.BatchColumn)
+	return fmt.Sprintf("SELECT COALESCE(MIN(%s), 0), COALESCE(MAX(%s), 0) FROM %s",
+		column, column, quoteQualifiedIdent(extractTableForMax(m.SQL)))
+}
+
+// nextBatchID returns the smallest batch id at or after from, or false if
+// there is none.
+func nextBatchID(ctx context.Context, conn *sql.Conn, m *Migration, from int64) (int64, bool, error) {
+	var next sql.NullInt64
+	err := conn.QueryRowContext(ctx, fmt.Sprintf("SELECT MIN(%s) FROM %s WHERE %s >= $1",
+		quoteQualifiedIdent(m.BatchColumn), quoteQualifiedIdent(extractTableForMax(m.SQL)),
+		quoteQualifiedIdent(m.BatchColumn)), from).Scan(&next)
+	if err != nil {
+		return 0, false, err
+	}
+	return next.Int64, next.Valid, nil
+}
+
+// rangeProgress returns how far lastID is through [minID, maxID], in percent.
+func rangeProgress(lastID, minID, maxID int64) float64 {
+	if maxID <= minID {
+		if lastID >= maxID {
+			return 100
+		}
+		return 0
+	}
+	pct := float64(lastID-minID) / float64(maxID-minID) * 100
+	return min(max(pct, 0), 100)
+}
+
+// expandChunkSQL substitutes the :start and :end placeholders for one chunk.
+func expandChunkSQL(sqlStr string, start, end int64) string {
+	chunkSQL := strings.ReplaceAll(sqlStr, ":start", fmt.Sprintf("%d", start))
+	return strings.ReplaceAll(chunkSQL, ":end", fmt.Sprintf("%d", end))
+}
+
+// tableTargetRe finds the start of the target table in an UPDATE or DELETE
+// statement; fromTableRe is the fallback for any other statement with a FROM.
+// notStatementRe matches what precedes an UPDATE keyword that isn't a
+// statement: ON CONFLICT ... DO UPDATE and FOR [NO KEY] UPDATE locking.
+var (
+	tableTargetRe  = regexp.MustCompile(`(?is)\b(?:UPDATE|DELETE\s+FROM)\s+(?:ONLY\s+)?`)
+	fromTableRe    = regexp.MustCompile(`(?is)\bFROM\s+(?:ONLY\s+)?`)
+	notStatementRe = regexp.MustCompile(`(?is)\b(?:DO|FOR|KEY)\s+$`)
+)
+
 // extractTableForMax attempts to extract the table name from an UPDATE or DELETE statement
 // for querying MAX(column). This is a simple heuristic.
-func extractTableForMax(sqlStr, column string) string {
-	upper := strings.ToUpper(sqlStr)
-	// Handle UPDATE table SET ...
-	if idx := strings.Index(upper, "UPDATE "); idx >= 0 {
-		rest := strings.TrimSpace(sqlStr[idx+7:])
-		fields := strings.Fields(rest)
-		if len(fields) > 0 {
-			return fields[0]
+func extractTableForMax(sqlStr string) string {
+	var loc []int
+	for _, m := range tableTargetRe.FindAllStringIndex(sqlStr, -1) {
+		if !notStatementRe.MatchString(sqlStr[:m[0]]) {
+			loc = m
+			break
 		}
 	}
-	// Handle DELETE FROM table ...
-	if idx := strings.Index(upper, "FROM "); idx >= 0 {
-		rest := strings.TrimSpace(sqlStr[idx+5:])
-		fields := strings.Fields(rest)
-		if len(fields) > 0 {
-			return fields[0]
-		}
+	if loc == nil {
+		loc = fromTableRe.FindStringIndex(sqlStr)
+	}
+	if loc == nil {
+		return "unknown_table"
+	}
+	rest := sqlStr[loc[1]:]
+	if _, n := scanIdentParts(rest); n > 0 {
+		return rest[:n]
 	}
 	return "unknown_table"
 }
 
-// stripWhereClause is unused but kept for reference.
-func stripWhereClause(s string) string { return s }
+// scanIdentParts reads a possibly schema-qualified identifier from the start
+// of s, returning its parts as written (quoted parts keep their quotes) and
+// the number of bytes consumed.
+func scanIdentParts(s string) ([]string, int) {
+	var parts []string
+	i := 0
+	for {
+		start := i
+		if i < len(s) && s[i] == '"' {
+			i++
+			for ; i < len(s); i++ {
+				if s[i] != '"' {
+					continue
+				}
+				if i+1 < len(s) && s[i+1] == '"' {
+					i++ // "" is an escaped quote
+					continue
+				}
+				break
+			}
+			if i >= len(s) {
+				return nil, 0
+			}
+			i++
+		} else {
+			for i < len(s) && isIdentChar(s[i]) {
+				i++
+			}
+			if i == start {
+				return nil, 0
+			}
+		}
+		parts = append(parts, s[start:i])
+		if i < len(s) && s[i] == '.' {
+			i++
+			continue
+		}
+		return parts, i
+	}
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// quoteQualifiedIdent quotes each part of a possibly schema-qualified
+// identifier. Parts already in double quotes are kept verbatim; unquoted parts
+// are folded to lower case, as PostgreSQL would, before quoting.
+func quoteQualifiedIdent(ident string) string {
+	parts, n := scanIdentParts(ident)
+	if n != len(ident) {
+		return pq.QuoteIdentifier(ident)
+	}
+	for i, p := range parts {
+		if !strings.HasPrefix(p, `"`) {
+			parts[i] = pq.QuoteIdentifier(strings.ToLower(p))
+		}
+	}
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"slices"
+	"testing"
+)
+
+func TestResumeStart(t *testing.T) {
+	planned := func(minID, last int64) MigrationRecord {
+		return MigrationRecord{MinID: sql.NullInt64{Int64: minID, Valid: true}, LastCompletedID: last}
+	}
+	tests := []struct {
+		name   string
+		record MigrationRecord
+		minID  int64
+		want   int64
+	}{
+		{"fresh", MigrationRecord{}, 1, 1},
+		{"fresh, high minimum", MigrationRecord{}, 500, 500},
+		{"unplanned row with progress", MigrationRecord{LastCompletedID: 100}, 1, 101},
+		{"planned, nothing done", planned(1, 0), 1, 1},
+		{"planned, progress", planned(1, 100), 1, 101},
+		{"rows below the checkpoint deleted", planned(1, 5), 50, 50},
+		{"negative range, nothing done", planned(-100, -101), -100, -100},
+		{"negative range, progress", planned(-100, -50), -100, -49},
+		{"checkpoint at 0", planned(-10, 0), -10, 1},
+	}
+	for _, tt := range tests {
+		if got := resumeStart(&tt.record, tt.minID); got != tt.want {
+			t.Errorf("%s: resumeStart(%+v, %d) = %d, want %d", tt.name, tt.record, tt.minID, got, tt.want)
+		}
+	}
+}
+
+func TestCheckpointDone(t *testing.T) {
+	type chunk struct {
+		start, end int64
+		mark       int64 // checkpoint after the chunk is done
+	}
+	tests := []struct {
+		name                 string
+		lastCompleted, minID int64
+		chunks               []chunk
+	}{
+		{
+			name:  "in order",
+			minID: 1,
+			chunks: []chunk{
+				{1, 10, 10},
+				{11, 20, 20},
+			},
+		},
+		{
+			name:  "out of order",
+			minID: 1,
+			chunks: []chunk{
+				{11, 20, 0},
+				{21, 30, 0},
+				{1, 10, 30},
+			},
+		},
+		{
+			name:  "gap left open",
+			minID: 1,
+			chunks: []chunk{
+				{1, 10, 10},
+				{21, 30, 10},
+				{31, 40, 10},
+			},
+		},
+		{
+			name:  "skip_gaps range covers a later claim",
+			minID: 1,
+			chunks: []chunk{
+				{1, 50, 50},
+				{11, 20, 50},
+				{51, 60, 60},
+			},
+		},
+		{
+			name:  "skip_gaps ranges overlap out of order",
+			minID: 1,
+			chunks: []chunk{
+				{11, 20, 0},
+				{1, 15, 20},
+			},
+		},
+		{
+			name:  "same start finished twice",
+			minID: 1,
+			chunks: []chunk{
+				{5, 30, 0},
+				{5, 9, 0},
+				{1, 4, 30},
+			},
+		},
+		{
+			name:          "resume past last completed",
+			lastCompleted: 100,
+			minID:         1,
+			chunks: []chunk{
+				{111, 120, 100},
+				{101, 110, 120},
+			},
+		},
+		{
+			name:          "resume below the table's minimum",
+			lastCompleted: 5,
+			minID:         50,
+			chunks: []chunk{
+				{60, 69, 49},
+				{50, 59, 69},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record := &MigrationRecord{LastCompletedID: tt.lastCompleted}
+			cp := newCheckpoint(resumeStart(record, tt.minID) - 1)
+			for _, c := range tt.chunks {
+				if got := cp.done(c.start, c.end); got != c.mark {
+					t.Fatalf("done(%d, %d) = %d, want %d", c.start, c.end, got, c.mark)
+				}
+			}
+			if got, want := cp.mark(), tt.chunks[len(tt.chunks)-1].mark; got != want {
+				t.Errorf("mark() = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestScanIdentParts(t *testing.T) {
+	tests := []struct {
+		in    string
+		parts []string
+		n     int
+	}{
+		{"users", []string{"users"}, 5},
+		{"public.users WHERE id > 0", []string{"public", "users"}, 12},
+		{`"My.Schema"."Tab""le" SET`, []string{`"My.Schema"`, `"Tab""le"`}, 21},
+		{`public."Users"`, []string{"public", `"Users"`}, 14},
+		{"$tbl_1", []string{"$tbl_1"}, 6},
+		{`"unterminated`, nil, 0},
+		{"public.", nil, 0},
+		{" users", nil, 0},
+		{"", nil, 0},
+	}
+	for _, tt := range tests {
+		parts, n := scanIdentParts(tt.in)
+		if !slices.Equal(parts, tt.parts) || n != tt.n {
+			t.Errorf("scanIdentParts(%q) = %q, %d, want %q, %d", tt.in, parts, n, tt.parts, tt.n)
+		}
+	}
+}
+
+func TestQuoteQualifiedIdent(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"users", `"users"`},
+		{"Users", `"users"`},
+		{"Sales.Orders", `"sales"."orders"`},
+		{`"Sales"."Orders"`, `"Sales"."Orders"`},
+		{`public."My.Table"`, `"public"."My.Table"`},
+		{`"Tab""le"`, `"Tab""le"`},
+		// Anything that isn't a whole identifier is quoted as a single name.
+		{"users; DROP TABLE x", `"users; DROP TABLE x"`},
+		{`bad"name`, `"bad""name"`},
+	}
+	for _, tt := range tests {
+		if got := quoteQualifiedIdent(tt.in); got != tt.want {
+			t.Errorf("quoteQualifiedIdent(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRetryBefore(t *testing.T) {
+	tests := []struct {
+		name      string
+		ranges    []chunkRange
+		startFrom int64
+		want      []chunkRange
+	}{
+		{"none saved", nil, 40, nil},
+		{"all behind the checkpoint", []chunkRange{{10, 19}, {30, 39}}, 40, []chunkRange{{10, 19}, {30, 39}}},
+		{"rerun by the main loop", []chunkRange{{10, 19}, {50, 59}}, 40, []chunkRange{{10, 19}}},
+		{"straddling startFrom", []chunkRange{{35, 44}}, 40, []chunkRange{{35, 39}}},
+		{"negative ids", []chunkRange{{-100, -91}, {-10, 5}}, 0, []chunkRange{{-100, -91}, {-10, -1}}},
+	}
+	for _, tt := range tests {
+		if got := retryBefore(tt.ranges, tt.startFrom); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: retryBefore(%v, %d) = %v, want %v", tt.name, tt.ranges, tt.startFrom, got, tt.want)
+		}
+	}
+}
+
+func TestChunkRangesRoundTrip(t *testing.T) {
+	tests := [][]chunkRange{
+		nil,
+		{{10, 20}},
+		{{-100, -91}, {-10, 5}, {10, 20}},
+		{{0, 0}, {-1, -1}},
+	}
+	for _, ranges := range tests {
+		s := formatChunkRanges(ranges)
+		if got := parseChunkRanges(s); !slices.Equal(got, ranges) {
+			t.Errorf("parseChunkRanges(%q) = %v, want %v", s, got, ranges)
+		}
+	}
+}
+
+func TestParseChunkRanges(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []chunkRange
+	}{
+		{"", nil},
+		{"10-20, 30-40", []chunkRange{{10, 20}, {30, 40}}},
+		{"-100--91", []chunkRange{{-100, -91}}},
+		{"10-20,junk,-5,30-x,40-50", []chunkRange{{10, 20}, {40, 50}}},
+	}
+	for _, tt := range tests {
+		if got := parseChunkRanges(tt.in); !slices.Equal(got, tt.want) {
+			t.Errorf("parseChunkRanges(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExtractTableForMax(t *testing.T) {
+	tests := []struct {
+		sql, want string
+	}{
+		{"UPDATE users SET x = 1 WHERE id BETWEEN :start AND :end", "users"},
+		{"update ONLY public.users set x = 1", "public.users"},
+		{`DELETE FROM "Audit"."Log" WHERE id BETWEEN :start AND :end`, `"Audit"."Log"`},
+		{"INSERT INTO archive SELECT * FROM events WHERE id BETWEEN :start AND :end", "events"},
+		{"INSERT INTO t2 (id, v) SELECT id, v FROM t1 WHERE id BETWEEN :start AND :end\nON CONFLICT (id) DO UPDATE SET v = EXCLUDED.v", "t1"},
+		{"WITH batch AS (SELECT id FROM jobs WHERE id BETWEEN :start AND :end FOR UPDATE SKIP LOCKED)\nUPDATE jobs SET done = true FROM batch", "jobs"},
+		{"WITH b AS (SELECT id FROM queue FOR NO KEY UPDATE) DELETE FROM queue USING b", "queue"},
+		{"VACUUM", "unknown_table"},
+	}
+	for _, tt := range tests {
+		if got := extractTableForMax(tt.sql); got != tt.want {
+			t.Errorf("extractTableForMax(%q) = %q, want %q", tt.sql, got, tt.want)
+		}
+	}
+}
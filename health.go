@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+)
+
+// healthStaleAfter is how old the last successful poll may be before the
+// daemon reports itself as not ready.
+const healthStaleAfter = 30 * time.Second
+
+// healthReport is the JSON body served by /healthz and /readyz.
+type healthReport struct {
+	Status    string    `json:"status"`
+	LastPoll  time.Time `json:"last_poll"`
+	StateDB   string    `json:"state_db"`
+	Running   []string  `json:"running"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ServeHealth starts an HTTP server on addr exposing /healthz (liveness),
+// /readyz (readiness) and /metrics (Prometheus). It returns once the listener
+// is bound.
+func (d *Daemon) ServeHealth(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, d.healthReport(r.Context(), "ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		report := d.healthReport(r.Context(), "ok")
+		code := http.StatusOK
+		if report.StateDB != "ok" || time.Since(report.LastPoll) > healthStaleAfter {
+			report.Status = "not ready"
+			code = http.StatusServiceUnavailable
+		}
+		writeHealth(w, code, report)
+	})
+	mux.HandleFunc("/metrics", d.metricsHandler)
+
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			d.logError("health server: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (d *Daemon) healthReport(ctx context.Context, status string) healthReport {
+	d.mu.Lock()
+	lastPoll := d.lastPoll
+	d.mu.Unlock()
+
+	dbStatus := "ok"
+	pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if err := d.StateDB.PingContext(pingCtx); err != nil {
+		dbStatus = err.Error()
+	}
+
+	return healthReport{
+		Status:    status,
+		LastPoll:  lastPoll,
+		StateDB:   dbStatus,
+		Running:   d.Executor.RunningNames(),
+		CheckedAt: time.Now(),
+	}
+}
+
+func writeHealth(w http.ResponseWriter, code int, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(report)
+}
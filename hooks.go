@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Hook events.
+const (
+	hookBeforeRun  = "before_run"
+	hookAfterChunk = "after_chunk"
+	hookAfterRun   = "after_run"
+	hookOnError    = "on_error"
+)
+
+// hookTimeout bounds how long a single hook command may run.
+const hookTimeout = 30 * time.Second
+
+// Hooks maps an event name to the shell commands run for it.
+type Hooks map[string][]string
+
+// HookPayload is written as JSON to a hook command's stdin.
+type HookPayload struct {
+	Event         string `json:"event"`
+	Name          string `json:"name"`
+	Service       string `json:"service"`
+	Status        string `json:"status,omitempty"`
+	ChunkStart    *int64 `json:"chunk_start,omitempty"`
+	ChunkEnd      *int64 `json:"chunk_end,omitempty"`
+	Rows          int64  `json:"rows"`
+	TotalAffected int64  `json:"total_affected"`
+	Error         string `json:"error,omitempty"`
+}
+
+// String implements flag.Value.
+func (h Hooks) String() string {
+	var parts []string
+	for event, cmds := range h {
+		for _, c := range cmds {
+			parts = append(parts, event+"="+c)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set implements flag.Value, accepting "event=command".
+func (h Hooks) Set(v string) error {
+	event, cmd, ok := strings.Cut(v, "=")
+	if !ok || strings.TrimSpace(cmd) == "" {
+		return fmt.Errorf("hook must be event=command")
+	}
+	switch event {
+	case hookBeforeRun, hookAfterChunk, hookAfterRun, hookOnError:
+	default:
+		return fmt.Errorf("unknown hook event %q", event)
+	}
+	h[event] = append(h[event], cmd)
+	return nil
+}
+
+// Run executes every command registered for the payload's event, stopping at
+// the first failure.
+func (h Hooks) Run(p HookPayload) error {
+	cmds := h[p.Event]
+	if len(cmds) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	for _, c := range cmds {
+		ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+		cmd := exec.CommandContext(ctx, "sh", "-c", c)
+		cmd.Stdin = bytes.NewReader(body)
+		cmd.Env = append(os.Environ(), "PSC_EVENT="+p.Event, "PSC_MIGRATION="+p.Name)
+		out, err := cmd.CombinedOutput()
+		cancel()
+		if err != nil {
+			msg := strings.TrimSpace(string(out))
+			if msg != "" {
+				return fmt.Errorf("hook %s %q: %w: %s", p.Event, c, err, msg)
+			}
+			return fmt.Errorf("hook %s %q: %w", p.Event, c, err)
+		}
+	}
+	return nil
+}
@@ -1,152 +1,420 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
 	"strings"
 
-	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/term"
 )
 
 // Version is set by goreleaser via ldflags.
 var version = "dev"
 
-func main() {
-	repo := flag.String("repo", ".", "path to migrations directory")
-	service := flag.String("service", "", "default pg_service.conf service name")
-	showVersion := flag.Bool("version", false, "print version and exit")
-	flag.Parse()
+// options holds the flags shared by all commands.
+type options struct {
+	repo         string
+	service      string
+	env          string
+	healthAddr   string
+	output       string
+	progressFile string
+	progressFD   int
+	logFile      string
+	logLevel     string
+	verbose      bool
+	veryVerbose  bool
+	verbosity    int // 0 default, 1 for -v, 2 for -vv
+	quiet        bool
+	hooks        Hooks
+	settings     settingsFlag
+}
 
-	if *showVersion {
-		fmt.Printf("psc %s\n", version)
-		return
-	}
+// settingsFlag collects repeated --set name=value flags.
+type settingsFlag map[string]string
 
-	args := flag.Args()
+func (s settingsFlag) String() string {
+	parts := make([]string, 0, len(s))
+	for name, value := range s {
+		parts = append(parts, name+"="+value)
+	}
+	return strings.Join(parts, ",")
+}
 
-	if len(args) == 0 {
-		// TUI daemon mode
-		runTUI(*repo, *service)
-		return
+func (s settingsFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, "=")
+	if !ok {
+		return fmt.Errorf("setting must be name=value")
+	}
+	if err := validateSettingName(name); err != nil {
+		return err
 	}
+	s[name] = value
+	return nil
+}
 
-	switch args[0] {
-	case "status":
-		runStatus(*repo, *service)
-	case "run":
-		if len(args) < 2 {
-			fmt.Fprintln(os.Stderr, "usage: psc run <name>")
-			os.Exit(1)
+// register adds the shared flags to fs. Defaults are the current values, so
+// flags given before the command are kept unless repeated after it.
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.repo, "repo", o.repo, "path to migrations directory")
+	fs.StringVar(&o.service, "service", o.service, "default pg_service.conf service name")
+	fs.StringVar(&o.env, "env", o.env, "environment name selecting psc:<directive>[env] overrides")
+	fs.Var(o.settings, "set", "session setting for every migration connection, as name=value (repeatable)")
+	fs.Var(o.hooks, "hook", "run a command on an event: before_run|after_chunk|after_run|on_error=<command> (repeatable)")
+	fs.StringVar(&o.logFile, "log-file", o.logFile, "append timestamped logs to this file")
+	fs.StringVar(&o.logLevel, "log-level", o.logLevel, "minimum log level: debug (includes chunk SQL), info, warn or error")
+}
+
+// logger builds the structured logger: --log-file at --log-level, plus
+// stderr at info (-v) or debug (-vv). It discards everything when neither
+// was requested.
+func (o options) logger() (*slog.Logger, error) {
+	var handlers []slog.Handler
+	if o.logFile != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(o.logLevel)); err != nil {
+			return nil, fmt.Errorf("--log-level: %w", err)
 		}
-		runSingle(*repo, *service, args[1])
-	case "cancel":
-		if len(args) < 2 {
-			fmt.Fprintln(os.Stderr, "usage: psc cancel <name>")
-			os.Exit(1)
+		f, err := os.OpenFile(o.logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
 		}
-		runCancel(*repo, *service, args[1])
-	default:
-		fmt.Fprintf(os.Stderr, "unknown command: %s\n", args[0])
-		os.Exit(1)
+		handlers = append(handlers, slog.NewTextHandler(f, &slog.HandlerOptions{Level: level}))
+	}
+	if o.verbosity > 0 {
+		level := slog.LevelInfo
+		if o.verbosity > 1 {
+			level = slog.LevelDebug
+		}
+		handlers = append(handlers, slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
 	}
+	switch len(handlers) {
+	case 0:
+		return slog.New(slog.DiscardHandler), nil
+	case 1:
+		return slog.New(handlers[0]), nil
+	}
+	return slog.New(teeHandler(handlers)), nil
 }
 
-func runTUI(repo, service string) {
-	d, err := NewDaemon(repo, service)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+// teeHandler sends each log record to every handler enabled for its level.
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, level) {
+			return true
+		}
 	}
-	defer d.StateDB.Close()
+	return false
+}
 
-	p := tea.NewProgram(NewModel(d), tea.WithAltScreen())
-	if _, err := p.Run(); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var firstErr error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
+	return firstErr
 }
 
-func runStatus(repo, service string) {
-	d, err := NewDaemon(repo, service)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
 	}
-	defer d.StateDB.Close()
+	return out
+}
 
-	if err := d.Poll(); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
 	}
+	return out
+}
 
-	records := d.Records()
-	if len(records) == 0 {
-		fmt.Println("No migrations found.")
-		return
+// newDaemon creates a Daemon configured from the shared flags.
+func (o options) newDaemon() (*Daemon, error) {
+	logger, err := o.logger()
+	if err != nil {
+		return nil, err
 	}
+	d, err := NewDaemon(o.repo, o.service, o.env)
+	if err != nil {
+		return nil, err
+	}
+	d.Executor.Logger = logger
+	d.Executor.Hooks = o.hooks
+	d.Executor.DefaultSettings = o.settings
+	return d, nil
+}
 
-	fmt.Printf("%-12s %-32s %-18s %s\n", "STATUS", "NAME", "PROGRESS", "AFFECTED")
-	fmt.Println(strings.Repeat("-", 80))
-	for _, r := range records {
-		progress := "—"
-		affected := "—"
-		if r.Status == "completed" {
-			progress = "100%"
+// reporter opens the outputs requested for a run command: human-readable
+// lines unless --output json, and an event stream to stdout and/or the
+// --progress-file/--progress-fd target. The returned func closes them.
+func (o options) reporter() (reporter, func()) {
+	out := reporter{text: o.output != "json" && !o.quiet}
+	// Verbose logs on stderr would tear an in-place progress line.
+	out.tty = out.text && o.verbosity == 0 && term.IsTerminal(os.Stdout.Fd())
+	var writers []io.Writer
+	if o.output == "json" {
+		writers = append(writers, os.Stdout)
+	}
+	var progress *os.File
+	switch {
+	case o.progressFile != "":
+		f, err := os.Create(o.progressFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
 		}
-		if r.TotalAffected > 0 {
-			affected = FormatNumber(r.TotalAffected)
+		progress = f
+	case o.progressFD != 0:
+		progress = os.NewFile(uintptr(o.progressFD), "progress-fd")
+	}
+	if progress != nil {
+		writers = append(writers, progress)
+	}
+	if len(writers) > 0 {
+		out.events = NewEventStream(io.MultiWriter(writers...))
+	}
+	return out, func() {
+		if progress != nil {
+			progress.Close()
 		}
-		fmt.Printf("%-12s %-32s %-18s %s\n", r.Status, r.Name, progress, affected)
 	}
 }
 
-func runSingle(repo, service, name string) {
-	d, err := NewDaemon(repo, service)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+// registerProgress adds the progress stream flags to fs.
+func (o *options) registerProgress(fs *flag.FlagSet) {
+	fs.StringVar(&o.progressFile, "progress-file", o.progressFile, "also write newline-delimited JSON progress events to this file")
+	fs.IntVar(&o.progressFD, "progress-fd", o.progressFD, "also write newline-delimited JSON progress events to this open file descriptor (3 or higher)")
+}
+
+// checkProgress rejects a --progress-fd of stdin, stdout or stderr (or a
+// negative one), exiting with the command's usage; --output json already
+// puts events on stdout.
+func (o *options) checkProgress(fs *flag.FlagSet) {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "progress-fd"
+	})
+	if set && o.progressFD <= 2 {
+		fmt.Fprintf(os.Stderr, "--progress-fd must be 3 or higher (got %d); use --output json for stdout\n\n", o.progressFD)
+		fs.Usage()
+		os.Exit(exitUsage)
 	}
-	defer d.StateDB.Close()
+}
+
+// registerOutput adds the output and verbosity flags to a run command's flag set.
+func (o *options) registerOutput(fs *flag.FlagSet) {
+	fs.StringVar(&o.output, "output", "text", "output format: text or json (newline-delimited events)")
+	fs.BoolVar(&o.verbose, "v", false, "log run progress and failed chunks to stderr")
+	fs.BoolVar(&o.veryVerbose, "vv", false, "also log every chunk's SQL and timing to stderr")
+	fs.BoolVar(&o.quiet, "quiet", false, "print only warnings and errors")
+}
 
-	if err := d.Poll(); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+// checkOutput validates the output flags, exiting with the command's usage
+// if they are inconsistent, and resolves the verbosity level.
+func (o *options) checkOutput(fs *flag.FlagSet) {
+	o.checkProgress(fs)
+	var problem string
+	switch {
+	case o.output != "text" && o.output != "json":
+		problem = fmt.Sprintf("unknown output format %q", o.output)
+	case o.quiet && (o.verbose || o.veryVerbose):
+		problem = "--quiet cannot be combined with -v or -vv"
 	}
+	if problem != "" {
+		fmt.Fprintf(os.Stderr, "%s\n\n", problem)
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	switch {
+	case o.veryVerbose:
+		o.verbosity = 2
+	case o.verbose:
+		o.verbosity = 1
+	}
+}
 
-	m := d.GetMigration(name)
-	if m == nil {
-		fmt.Fprintf(os.Stderr, "migration %q not found in repo\n", name)
-		os.Exit(1)
+// newFlagSet creates the flag set for a command, including the shared flags.
+func newFlagSet(name, usage string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: psc %s\n\nflags:\n", usage)
+		fs.PrintDefaults()
 	}
+	opts.register(fs)
+	return fs
+}
 
-	record, err := GetMigrationByName(d.StateDB, name)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+// requireArg returns the single positional argument of a command, exiting
+// with its usage if it is missing.
+func requireArg(fs *flag.FlagSet) string {
+	if fs.NArg() < 1 {
+		fs.Usage()
+		os.Exit(exitUsage)
+	}
+	return fs.Arg(0)
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: psc [flags] [command] [command flags]
+
+commands:
+  daemon                 watch --repo and run the interactive TUI (default)
+  migrate run <name>     run one migration synchronously
+  migrate up             run all pending migrations in order, then exit
+  migrate status         list migrations (--json for machine-readable output)
+  migrate cancel <name>  mark a migration as cancelled
+  migrate clean          remove state for migrations whose files were deleted
+  status, run, cancel,
+  clean                  shorthands for the migrate commands above
+  services list          list services defined in pg_service.conf
+  services test [name]   test-connect to one or every service
+  describe <table>       show a table's columns, keys, indexes, size and id range on --service
+  doctor                 check pg_service.conf, connectivity, state table and migrations
+  help                   show this help
+
+Run 'psc <command> -h' for command flags.
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	opts := options{repo: ".", output: "text", logLevel: "info", hooks: Hooks{}, settings: settingsFlag{}}
+	opts.register(flag.CommandLine)
+	flag.StringVar(&opts.healthAddr, "health-addr", "", "serve /healthz, /readyz and /metrics on this address in daemon mode (e.g. :8080)")
+	showVersion := flag.Bool("version", false, "print version and exit")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Printf("psc %s\n", version)
+		return
 	}
 
-	fmt.Printf("Running migration: %s\n", name)
-	if err := d.Executor.Run(m, record); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+	args := flag.Args()
+	if len(args) == 0 {
+		// TUI daemon mode
+		runTUI(opts)
+		return
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "daemon":
+		fs := newFlagSet("daemon", "daemon [flags]", &opts)
+		fs.StringVar(&opts.healthAddr, "health-addr", opts.healthAddr, "serve /healthz, /readyz and /metrics on this address (e.g. :8080)")
+		opts.registerProgress(fs)
+		fs.Parse(args)
+		opts.checkProgress(fs)
+		runTUI(opts)
+	case "migrate":
+		if len(args) == 0 {
+			usage()
+			os.Exit(exitUsage)
+		}
+		runMigrate(opts, args[0], args[1:])
+	case "status", "run", "cancel", "clean":
+		runMigrate(opts, cmd, args)
+	case "describe":
+		fs := newFlagSet("describe", "describe [flags] <table>", &opts)
+		table := fs.String("table", "", "table to describe, optionally schema-qualified")
+		fs.Parse(args)
+		if *table == "" {
+			*table = requireArg(fs)
+		}
+		if opts.service == "" {
+			fmt.Fprintf(os.Stderr, "--service is required\n\n")
+			fs.Usage()
+			os.Exit(exitUsage)
+		}
+		runDescribe(opts, *table)
+	case "services":
+		runServices(opts, args)
+	case "doctor":
+		fs := newFlagSet("doctor", "doctor [flags]", &opts)
+		fs.Parse(args)
+		runDoctor(opts)
+	case "help", "-h", "--help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", cmd)
+		usage()
+		os.Exit(exitUsage)
 	}
-	fmt.Println("Done.")
 }
 
-func runCancel(repo, service, name string) {
-	// Cancel only works in TUI/daemon mode since it requires the running context.
-	// For CLI, we just set the status to cancelled in the DB.
-	d, err := NewDaemon(repo, service)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+// runMigrate dispatches the migrate subcommands.
+func runMigrate(opts options, cmd string, args []string) {
+	switch cmd {
+	case "run":
+		fs := newFlagSet("migrate run", "migrate run [flags] <name>", &opts)
+		opts.registerOutput(fs)
+		opts.registerProgress(fs)
+		fs.Parse(args)
+		opts.checkOutput(fs)
+		runSingle(opts, requireArg(fs))
+	case "up":
+		fs := newFlagSet("migrate up", "migrate up [flags]", &opts)
+		opts.registerOutput(fs)
+		opts.registerProgress(fs)
+		fs.Parse(args)
+		opts.checkOutput(fs)
+		runUp(opts)
+	case "status":
+		fs := newFlagSet("migrate status", "migrate status [flags]", &opts)
+		jsonOut := fs.Bool("json", false, "print migrations as JSON")
+		fs.Parse(args)
+		runStatus(opts, *jsonOut)
+	case "cancel":
+		fs := newFlagSet("migrate cancel", "migrate cancel [flags] <name>", &opts)
+		fs.Parse(args)
+		runCancel(opts, requireArg(fs))
+	case "clean":
+		fs := newFlagSet("migrate clean", "migrate clean [flags]", &opts)
+		olderThan := fs.Duration("older-than", 0, "only remove rows not updated for at least this long (e.g. 720h)")
+		dryRun := fs.Bool("dry-run", false, "list the rows that would be removed without deleting them")
+		fs.Parse(args)
+		runClean(opts, *olderThan, *dryRun)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown migrate command: %s\n\n", cmd)
+		usage()
+		os.Exit(exitUsage)
 	}
-	defer d.StateDB.Close()
+}
 
-	if err := UpdateStatus(d.StateDB, name, "cancelled"); err != nil {
-		fmt.Fprintf(os.Stderr, "error: %v\n", err)
-		os.Exit(1)
+// runServices dispatches the services subcommands.
+func runServices(opts options, args []string) {
+	if len(args) == 0 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	switch args[0] {
+	case "list":
+		fs := newFlagSet("services list", "services list", &opts)
+		fs.Parse(args[1:])
+		runServicesList()
+	case "test":
+		fs := newFlagSet("services test", "services test [name ...]", &opts)
+		fs.Parse(args[1:])
+		runServicesTest(fs.Args())
+	default:
+		fmt.Fprintf(os.Stderr, "unknown services command: %s\n\n", args[0])
+		usage()
+		os.Exit(exitUsage)
 	}
-	fmt.Printf("Migration %q marked as cancelled.\n", name)
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// chunkBuckets are the upper bounds (seconds) of the chunk duration histogram.
+var chunkBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// chunkHistogram accumulates chunk durations for one migration.
+type chunkHistogram struct {
+	counts []uint64 // per bucket, cumulative counts are computed on export
+	sum    float64
+	count  uint64
+	failed uint64
+}
+
+// Metrics collects executor timings exported in Prometheus text format.
+type Metrics struct {
+	mu     sync.Mutex
+	chunks map[string]*chunkHistogram
+}
+
+// NewMetrics creates an empty Metrics collector.
+func NewMetrics() *Metrics {
+	return &Metrics{chunks: make(map[string]*chunkHistogram)}
+}
+
+// ObserveChunk records the duration and outcome of one executed chunk (or
+// single statement).
+func (mt *Metrics) ObserveChunk(name string, d time.Duration, err error) {
+	if mt == nil {
+		return
+	}
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	h, ok := mt.chunks[name]
+	if !ok {
+		h = &chunkHistogram{counts: make([]uint64, len(chunkBuckets))}
+		mt.chunks[name] = h
+	}
+	sec := d.Seconds()
+	for i, le := range chunkBuckets {
+		if sec <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += sec
+	h.count++
+	if err != nil {
+		h.failed++
+	}
+}
+
+// writeChunks writes the chunk histogram and counters.
+func (mt *Metrics) writeChunks(w io.Writer) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+
+	names := make([]string, 0, len(mt.chunks))
+	for name := range mt.chunks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "# HELP psc_chunk_duration_seconds Duration of executed chunks.")
+	fmt.Fprintln(w, "# TYPE psc_chunk_duration_seconds histogram")
+	for _, name := range names {
+		h := mt.chunks[name]
+		var cum uint64
+		for i, le := range chunkBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "psc_chunk_duration_seconds_bucket{name=%q,le=\"%g\"} %d\n", name, le, cum)
+		}
+		fmt.Fprintf(w, "psc_chunk_duration_seconds_bucket{name=%q,le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(w, "psc_chunk_duration_seconds_sum{name=%q} %g\n", name, h.sum)
+		fmt.Fprintf(w, "psc_chunk_duration_seconds_count{name=%q} %d\n", name, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP psc_chunks_failed_total Chunks that returned an error.")
+	fmt.Fprintln(w, "# TYPE psc_chunks_failed_total counter")
+	for _, name := range names {
+		fmt.Fprintf(w, "psc_chunks_failed_total{name=%q} %d\n", name, mt.chunks[name].failed)
+	}
+}
+
+// metricsHandler serves migration state and executor timings.
+func (d *Daemon) metricsHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	records := d.Records()
+	byStatus := map[string]int{"pending": 0, "running": 0, "completed": 0, "failed": 0, "cancelled": 0}
+	for _, r := range records {
+		byStatus[r.Status]++
+	}
+	statuses := make([]string, 0, len(byStatus))
+	for s := range byStatus {
+		statuses = append(statuses, s)
+	}
+	sort.Strings(statuses)
+
+	fmt.Fprintln(w, "# HELP psc_migrations Number of migrations by status.")
+	fmt.Fprintln(w, "# TYPE psc_migrations gauge")
+	for _, s := range statuses {
+		fmt.Fprintf(w, "psc_migrations{status=%q} %d\n", s, byStatus[s])
+	}
+
+	fmt.Fprintln(w, "# HELP psc_migration_rows_affected Rows affected so far by each migration.")
+	fmt.Fprintln(w, "# TYPE psc_migration_rows_affected gauge")
+	for _, r := range records {
+		affected := r.TotalAffected
+		if es := d.Executor.GetState(r.Name); es != nil {
+			affected = es.TotalAffected.Load()
+		}
+		fmt.Fprintf(w, "psc_migration_rows_affected{name=%q} %d\n", r.Name, affected)
+	}
+
+	fmt.Fprintln(w, "# HELP psc_migration_errors_total Errors recorded for each migration.")
+	fmt.Fprintln(w, "# TYPE psc_migration_errors_total counter")
+	for _, r := range records {
+		fmt.Fprintf(w, "psc_migration_errors_total{name=%q} %d\n", r.Name, r.ErrorCount)
+	}
+
+	d.Executor.metrics.writeChunks(w)
+}
@@ -11,15 +11,21 @@ import (
 
 // Migration represents a parsed SQL migration file.
 type Migration struct {
-	Name        string
-	Filename    string
-	SQL         string
-	Service     string // target pg_service name (may be empty for default)
-	BatchColumn string
-	ChunkSize   int
-	Parallelism int
-	OnError     string // "abort" or "continue"
-	Timeout     time.Duration
+	Name           string
+	Filename       string
+	SQL            string
+	Service        string // target pg_service name (may be empty for default)
+	BatchColumn    string
+	ChunkSize      int
+	Parallelism    int
+	SkipGaps       bool   // probe for the next existing id instead of running empty chunks
+	OnError        string // "abort" or "continue"
+	Timeout        time.Duration
+	TimeoutRetries int               // retries for chunks that hit Timeout
+	Settings       map[string]string // session GUCs applied to each worker connection
+	MaxRowsPerSec  int               // 0 = unthrottled
+	MaxReplicaLag  time.Duration     // pause while target replica lag exceeds this
+	After          string            // post-run maintenance: "", "analyze" or "vacuum"
 }
 
 // IsBatched returns true if the migration uses batch processing.
@@ -27,8 +33,21 @@ func (m *Migration) IsBatched() bool {
 	return m.BatchColumn != ""
 }
 
+// ParseError is a migration file that failed to parse. Name is its
+// psc:migrate name, or "" if none was read.
+type ParseError struct {
+	Name string
+	Err  error
+}
+
+func (e *ParseError) Error() string { return e.Err.Error() }
+func (e *ParseError) Unwrap() error { return e.Err }
+
 // ParseMigrationFile parses a .sql migration file and extracts psc directives.
-func ParseMigrationFile(path string) (*Migration, error) {
+// Directives scoped to an environment (e.g. psc:batch[prod]) are applied after
+// the unscoped ones when env matches, and ignored otherwise. Errors in the
+// file's contents are *ParseError.
+func ParseMigrationFile(path, env string) (*Migration, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -40,8 +59,17 @@ func ParseMigrationFile(path string) (*Migration, error) {
 		OnError:     "abort",
 		Parallelism: 1,
 		ChunkSize:   10000,
+		Settings:    make(map[string]string),
 	}
 	var sqlLines []string
+	var envDirectives []string
+	// Keep reading past a bad directive so the error can name the migration.
+	var firstErr error
+	fail := func(err error) {
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", path, err)
+		}
+	}
 
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
@@ -50,8 +78,19 @@ func ParseMigrationFile(path string) (*Migration, error) {
 
 		if strings.HasPrefix(trimmed, "-- psc:") {
 			directive := strings.TrimPrefix(trimmed, "-- psc:")
+			directive, scope, err := splitDirectiveEnv(directive)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			if scope != "" {
+				if scope == env {
+					envDirectives = append(envDirectives, directive)
+				}
+				continue
+			}
 			if err := parseDirective(m, directive); err != nil {
-				return nil, fmt.Errorf("%s: %w", path, err)
+				fail(err)
 			}
 		} else {
 			sqlLines = append(sqlLines, line)
@@ -60,14 +99,49 @@ func ParseMigrationFile(path string) (*Migration, error) {
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
+	for _, directive := range envDirectives {
+		if err := parseDirective(m, directive); err != nil {
+			fail(err)
+		}
+	}
 
 	m.SQL = strings.TrimSpace(strings.Join(sqlLines, "\n"))
 	if m.Name == "" {
-		return nil, fmt.Errorf("%s: missing required psc:migrate name=<name> directive", path)
+		fail(fmt.Errorf("missing required psc:migrate name=<name> directive"))
+	}
+	if firstErr == nil {
+		if err := validateMigration(m); err != nil {
+			fail(err)
+		}
+	}
+	if firstErr != nil {
+		return nil, &ParseError{Name: m.Name, Err: firstErr}
 	}
 	return m, nil
 }
 
+// splitDirectiveEnv strips an environment scope from a directive such as
+// "batch[prod] chunk=1000", returning the unscoped directive and the scope.
+func splitDirectiveEnv(directive string) (string, string, error) {
+	directive = strings.TrimSpace(directive)
+	keyword, rest, _ := strings.Cut(directive, " ")
+	open := strings.Index(keyword, "[")
+	if open < 0 {
+		return directive, "", nil
+	}
+	if open == 0 || !strings.HasSuffix(keyword, "]") {
+		return "", "", fmt.Errorf("malformed directive %q", keyword)
+	}
+	name, scope := keyword[:open], keyword[open+1:len(keyword)-1]
+	if scope == "" {
+		return "", "", fmt.Errorf("empty environment in directive %q", keyword)
+	}
+	if name == "migrate" {
+		return "", "", fmt.Errorf("psc:migrate cannot be scoped to an environment")
+	}
+	return strings.TrimSpace(name + " " + rest), scope, nil
+}
+
 func parseDirective(m *Migration, directive string) error {
 	parts := strings.Fields(directive)
 	if len(parts) == 0 {
@@ -91,13 +165,56 @@ func parseDirective(m *Migration, directive string) error {
 			m.BatchColumn = v
 		}
 		if v, ok := kv["chunk"]; ok {
-			if n, err := strconv.Atoi(v); err == nil {
-				m.ChunkSize = n
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid chunk size %q", v)
 			}
+			m.ChunkSize = n
 		}
 		if v, ok := kv["parallelism"]; ok {
-			if n, err := strconv.Atoi(v); err == nil {
-				m.Parallelism = n
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid parallelism %q", v)
+			}
+			m.Parallelism = n
+		}
+		if v, ok := kv["skip_gaps"]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("invalid skip_gaps %q", v)
+			}
+			m.SkipGaps = b
+		}
+	case "set":
+		for name, value := range parseKV(parts[1:]) {
+			if err := validateSettingName(name); err != nil {
+				return err
+			}
+			m.Settings[name] = value
+		}
+	case "throttle":
+		kv := parseKV(parts[1:])
+		if v, ok := kv["rows_per_sec"]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid rows_per_sec %q", v)
+			}
+			m.MaxRowsPerSec = n
+		}
+		if v, ok := kv["max_lag"]; ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid max_lag: %w", err)
+			}
+			m.MaxReplicaLag = d
+		}
+	case "after":
+		if len(parts) > 1 {
+			switch parts[1] {
+			case "analyze", "vacuum":
+				m.After = parts[1]
+			default:
+				return fmt.Errorf("invalid after %q: must be analyze or vacuum", parts[1])
 			}
 		}
 	case "on_error":
@@ -112,6 +229,13 @@ func parseDirective(m *Migration, directive string) error {
 			}
 			m.Timeout = d
 		}
+		if v, ok := parseKV(parts[1:])["retries"]; ok {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid timeout retries %q", v)
+			}
+			m.TimeoutRetries = n
+		}
 	}
 	return nil
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitDirectiveEnv(t *testing.T) {
+	tests := []struct {
+		in, directive, scope string
+		err                  string
+	}{
+		{in: "batch column=id chunk=1000", directive: "batch column=id chunk=1000"},
+		{in: "  on_error continue ", directive: "on_error continue"},
+		{in: "batch[prod] chunk=500", directive: "batch chunk=500", scope: "prod"},
+		{in: "after[staging]", directive: "after", scope: "staging"},
+		{in: "migrate[prod] name=x", err: "cannot be scoped"},
+		{in: "batch[] chunk=5", err: "empty environment"},
+		{in: "batch[prod chunk=5", err: "malformed directive"},
+		{in: "[prod] chunk=5", err: "malformed directive"},
+	}
+	for _, tt := range tests {
+		directive, scope, err := splitDirectiveEnv(tt.in)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("splitDirectiveEnv(%q) error = %v, want one containing %q", tt.in, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || directive != tt.directive || scope != tt.scope {
+			t.Errorf("splitDirectiveEnv(%q) = %q, %q, %v, want %q, %q", tt.in, directive, scope, err, tt.directive, tt.scope)
+		}
+	}
+}
+
+func TestParseMigrationFileEnv(t *testing.T) {
+	const src = `-- psc:batch[prod] chunk=500 parallelism=4
+-- psc:migrate name=backfill
+-- psc:batch column=id chunk=1000
+-- psc:on_error[staging] continue
+-- psc:set work_mem=64MB
+-- psc:set[prod] work_mem=256MB
+UPDATE users SET x = 1 WHERE id BETWEEN :start AND :end;
+`
+	path := filepath.Join(t.TempDir(), "backfill.sql")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		env         string
+		chunk       int
+		parallelism int
+		onError     string
+		workMem     string
+	}{
+		{"", 1000, 1, "abort", "64MB"},
+		{"dev", 1000, 1, "abort", "64MB"},
+		// Scoped directives apply after unscoped ones, wherever they appear.
+		{"prod", 500, 4, "abort", "256MB"},
+		{"staging", 1000, 1, "continue", "64MB"},
+	}
+	for _, tt := range tests {
+		m, err := ParseMigrationFile(path, tt.env)
+		if err != nil {
+			t.Fatalf("env %q: %v", tt.env, err)
+		}
+		if m.ChunkSize != tt.chunk || m.Parallelism != tt.parallelism || m.OnError != tt.onError || m.Settings["work_mem"] != tt.workMem {
+			t.Errorf("env %q: chunk=%d parallelism=%d on_error=%s work_mem=%s, want %d %d %s %s", tt.env,
+				m.ChunkSize, m.Parallelism, m.OnError, m.Settings["work_mem"], tt.chunk, tt.parallelism, tt.onError, tt.workMem)
+		}
+	}
+}
+
+func TestParseMigrationFileEnvErrors(t *testing.T) {
+	tests := []struct {
+		name, env, src, err string
+	}{
+		{"scoped migrate", "dev", "-- psc:migrate[prod] name=x\nSELECT 1;\n", "cannot be scoped"},
+		{"empty scope", "dev", "-- psc:migrate name=x\n-- psc:batch[] chunk=5\nSELECT 1;\n", "empty environment"},
+		{"unclosed scope", "dev", "-- psc:migrate name=x\n-- psc:batch[prod chunk=5\nSELECT 1;\n", "malformed directive"},
+		{"bad value in selected env", "prod", "-- psc:migrate name=x\n-- psc:timeout[prod] soon\nSELECT 1;\n", "invalid timeout"},
+		// Directives for other environments are never parsed.
+		{"bad value in other env", "dev", "-- psc:migrate name=x\n-- psc:timeout[prod] soon\nSELECT 1;\n", ""},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, "m.sql")
+		if err := os.WriteFile(path, []byte(tt.src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ParseMigrationFile(path, tt.env)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want one containing %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestParseErrorName(t *testing.T) {
+	tests := []struct {
+		src, name string
+	}{
+		{"-- psc:batch chunk=lots\n-- psc:migrate name=backfill\nSELECT 1;\n", "backfill"},
+		{"-- psc:migrate name=backfill\n-- psc:on_error sometimes\nSELECT 1;\n", "backfill"},
+		{"-- psc:batch chunk=100\nSELECT 1;\n", ""},
+	}
+	path := filepath.Join(t.TempDir(), "m.sql")
+	for _, tt := range tests {
+		if err := os.WriteFile(path, []byte(tt.src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ParseMigrationFile(path, "")
+		var pe *ParseError
+		if !errors.As(err, &pe) || pe.Name != tt.name {
+			t.Errorf("ParseMigrationFile(%q) error = %#v, want a ParseError named %q", tt.src, err, tt.name)
+		}
+	}
+}
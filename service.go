@@ -85,14 +85,35 @@ func (c ServiceConfig) ConnectionStringWithSSL(sslmode string) string {
 		c.Host, c.Port, c.DBName, c.User, c.Password, sslmode)
 }
 
+// ServiceFilePath returns the location of the user's pg_service.conf.
+func ServiceFilePath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".pg_service.conf"), nil
+}
+
+// ConnectError reports that a service could not be reached.
+type ConnectError struct {
+	Service string
+	Err     error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connecting to %s: %v", e.Service, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error { return e.Err }
+
 // ConnectService opens a DB connection to the given pg_service.conf service name.
 // It tries SSL first, then falls back to sslmode=disable.
 func ConnectService(serviceName string) (*sql.DB, error) {
-	home, err := os.UserHomeDir()
+	path, err := ServiceFilePath()
 	if err != nil {
 		return nil, err
 	}
-	services, err := ParseServiceFile(filepath.Join(home, ".pg_service.conf"))
+	services, err := ParseServiceFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("parsing pg_service.conf: %w", err)
 	}
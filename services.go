@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// serviceProbe is the result of test-connecting to a service.
+type serviceProbe struct {
+	Connect   time.Duration // time to open and ping, including any SSL fallback
+	RoundTrip time.Duration // one SELECT 1 on the open connection
+	Version   string
+	SSL       bool
+}
+
+// probeService connects to a service through ConnectService and measures it.
+func probeService(name string) (serviceProbe, error) {
+	var p serviceProbe
+	start := time.Now()
+	db, err := ConnectService(name)
+	if err != nil {
+		return p, err
+	}
+	defer db.Close()
+	p.Connect = time.Since(start)
+
+	start = time.Now()
+	if _, err := db.Exec(`SELECT 1`); err != nil {
+		return p, err
+	}
+	p.RoundTrip = time.Since(start)
+
+	err = db.QueryRow(`
+		SELECT current_setting('server_version'),
+		       COALESCE((SELECT ssl FROM pg_stat_ssl WHERE pid = pg_backend_pid()), false)`).Scan(&p.Version, &p.SSL)
+	return p, err
+}
+
+// loadServices parses pg_service.conf, exiting on failure, and returns it
+// with its service names sorted.
+func loadServices() (map[string]ServiceConfig, []string) {
+	path, err := ServiceFilePath()
+	if err != nil {
+		fatal(err)
+	}
+	services, err := ParseServiceFile(path)
+	if err != nil {
+		fatal(err)
+	}
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return services, names
+}
+
+// runServicesList prints every service defined in pg_service.conf.
+func runServicesList() {
+	services, names := loadServices()
+	if len(names) == 0 {
+		fmt.Println("No services defined.")
+		return
+	}
+	fmt.Printf("%-24s %-16s %-32s %-6s %s\n", "SERVICE", "USER", "HOST", "PORT", "DBNAME")
+	for _, name := range names {
+		cfg := services[name]
+		fmt.Printf("%-24s %-16s %-32s %-6s %s\n", name, cfg.User, cfg.Host, cfg.Port, cfg.DBName)
+	}
+}
+
+// runServicesTest connects to the named services, or all of them, reporting
+// latency, server version and whether SSL was negotiated. It exits with
+// exitConnection if any service is unreachable.
+func runServicesTest(names []string) {
+	services, all := loadServices()
+	if len(names) == 0 {
+		names = all
+	}
+	unreachable := 0
+	for _, name := range names {
+		if !hasService(services, name) {
+			fmt.Printf("%-24s not defined in pg_service.conf\n", name)
+			unreachable++
+			continue
+		}
+		p, err := probeService(name)
+		if err != nil {
+			fmt.Printf("%-24s FAIL  %v\n", name, err)
+			unreachable++
+			continue
+		}
+		ssl := "no ssl"
+		if p.SSL {
+			ssl = "ssl"
+		}
+		fmt.Printf("%-24s ok    connect %s, query %s, PostgreSQL %s, %s\n", name,
+			p.Connect.Round(time.Millisecond), p.RoundTrip.Round(100*time.Microsecond), p.Version, ssl)
+	}
+	if unreachable > 0 {
+		os.Exit(exitConnection)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// rateLimiter paces work across all workers of a migration so the cumulative
+// rate stays at or below a rows/sec limit.
+type rateLimiter struct {
+	mu    sync.Mutex
+	limit float64
+	start time.Time
+	total int64
+}
+
+func newRateLimiter(rowsPerSec int) *rateLimiter {
+	if rowsPerSec <= 0 {
+		return nil
+	}
+	return &rateLimiter{limit: float64(rowsPerSec), start: time.Now()}
+}
+
+// Wait accounts for n processed rows and blocks until the overall rate is back
+// under the limit, ctx is done, or stop is closed.
+func (l *rateLimiter) Wait(ctx context.Context, n int64, stop <-chan struct{}) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	l.total += n
+	due := l.start.Add(time.Duration(float64(l.total) / l.limit * float64(time.Second)))
+	l.mu.Unlock()
+
+	return sleepCtx(ctx, time.Until(due), stop)
+}
+
+// errDraining is returned by throttle waits cut short because the migration
+// is draining.
+var errDraining = errors.New("migration is draining")
+
+// sleepCtx sleeps for d, until ctx is done, or until stop is closed.
+func sleepCtx(ctx context.Context, d time.Duration, stop <-chan struct{}) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-stop:
+		return errDraining
+	case <-t.C:
+		return nil
+	}
+}
+
+// lagPollInterval is how often replica lag is re-checked while throttling.
+const lagPollInterval = time.Second
+
+// lagGate pauses workers while the target's replication lag exceeds a limit.
+type lagGate struct {
+	db   *sql.DB
+	max  time.Duration
+	es   *ExecutionState
+	warn func(msg string) // told once when lag can't be read
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	lag       time.Duration
+	warned    bool
+}
+
+func newLagGate(db *sql.DB, max time.Duration, es *ExecutionState, warn func(string)) *lagGate {
+	if max <= 0 {
+		return nil
+	}
+	return &lagGate{db: db, max: max, es: es, warn: warn}
+}
+
+// Wait blocks until replica lag is at or below the limit, ctx is done, or the
+// migration starts draining.
+func (g *lagGate) Wait(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	for {
+		lag, err := g.current(ctx)
+		if err != nil {
+			return err
+		}
+		g.es.ReplicaLag.Store(int64(lag))
+		if lag <= g.max {
+			g.es.Paused.Store(false)
+			return nil
+		}
+		g.es.Paused.Store(true)
+		if err := sleepCtx(ctx, lagPollInterval, g.es.drained); err != nil {
+			return err
+		}
+	}
+}
+
+// current returns the largest replay lag across replicas, querying the target
+// at most once per lagPollInterval.
+func (g *lagGate) current(ctx context.Context) (time.Duration, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.checkedAt) < lagPollInterval {
+		return g.lag, nil
+	}
+	// Without pg_monitor, other roles' walsenders show up with NULL state
+	// and lag, which would otherwise read as no lag at all.
+	var replicas, visible int
+	var seconds float64
+	err := g.db.QueryRowContext(ctx, `
+		SELECT count(*), count(state), COALESCE(EXTRACT(EPOCH FROM MAX(replay_lag)), 0)
+		FROM pg_stat_replication`).Scan(&replicas, &visible, &seconds)
+	if err != nil {
+		return 0, fmt.Errorf("checking replication lag: %w", err)
+	}
+	switch {
+	case replicas == 0:
+		g.warnOnce("no replicas in pg_stat_replication on the target; max_lag has no effect")
+	case visible < replicas:
+		g.warnOnce(fmt.Sprintf("cannot read lag of %d of %d replicas (grant pg_monitor to the migration role); max_lag only covers the rest", replicas-visible, replicas))
+	}
+	g.lag = time.Duration(seconds * float64(time.Second))
+	g.checkedAt = time.Now()
+	return g.lag, nil
+}
+
+// warnOnce reports msg the first time lag can't be fully read. g.mu must be
+// held.
+func (g *lagGate) warnOnce(msg string) {
+	if g.warned || g.warn == nil {
+		return
+	}
+	g.warned = true
+	g.warn(msg)
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
+	"sort"
 	"strings"
 	"time"
 
@@ -11,8 +13,9 @@ import (
 
 // TUI screens
 const (
-	screenList   = "list"
-	screenDetail = "detail"
+	screenList    = "list"
+	screenDetail  = "detail"
+	screenPreview = "preview"
 )
 
 // tickMsg triggers periodic refresh.
@@ -75,10 +78,9 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			if es := m.daemon.Executor.GetState(m.records[i].Name); es != nil {
 				m.records[i].TotalAffected = es.TotalAffected.Load()
 				m.records[i].LastCompletedID = es.LastCompletedID.Load()
-				if es.MaxID > 0 {
-					maxID := es.MaxID
-					m.records[i].MaxID.Int64 = maxID
-					m.records[i].MaxID.Valid = true
+				if minID, maxID, ok := es.IDRange(); ok {
+					m.records[i].MinID = sql.NullInt64{Int64: minID, Valid: true}
+					m.records[i].MaxID = sql.NullInt64{Int64: maxID, Valid: true}
 				}
 			}
 		}
@@ -113,7 +115,8 @@ func (m Model) handleKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 	case "r":
 		if m.screen == screenList && len(m.records) > 0 {
 			r := m.records[m.cursor]
-			if r.Status == "pending" || r.Status == "failed" || r.Status == "cancelled" {
+			stale := r.Status == "running" && !m.daemon.Executor.IsRunning(r.Name)
+			if r.Status == "pending" || r.Status == "failed" || r.Status == "cancelled" || r.NeedsRetry() || stale {
 				if err := m.daemon.RunMigration(r.Name); err != nil {
 					m.err = err.Error()
 				}
@@ -132,8 +135,12 @@ func (m Model) handleKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
 		if m.screen == screenList && len(m.records) > 0 {
 			m.screen = screenDetail
 		}
+	case "p":
+		if (m.screen == screenList || m.screen == screenDetail) && len(m.records) > 0 {
+			m.screen = screenPreview
+		}
 	case "b", "esc":
-		if m.screen == screenDetail {
+		if m.screen == screenDetail || m.screen == screenPreview {
 			m.screen = screenList
 		}
 	}
@@ -165,8 +172,11 @@ var (
 )
 
 func (m Model) View() string {
-	if m.screen == screenDetail {
+	switch m.screen {
+	case screenDetail:
 		return m.viewDetail()
+	case screenPreview:
+		return m.viewPreview()
 	}
 	return m.viewList()
 }
@@ -208,7 +218,7 @@ func (m Model) viewList() string {
 	}
 
 	// Help
-	b.WriteString(helpStyle.Render(" [r] run  [c] cancel  [d] details  [↑↓] navigate  [q] quit"))
+	b.WriteString(helpStyle.Render(" [r] run  [c] cancel  [d] details  [p] preview  [↑↓] navigate  [q] quit"))
 	return b.String()
 }
 
@@ -223,6 +233,9 @@ func formatRow(r MigrationRecord, exec *Executor) string {
 	case "running":
 		icon = runStyle.Render("🔄 run")
 		progress = progressBar(r)
+		if es := exec.GetState(r.Name); es != nil && es.Phase() != "" {
+			progress = es.Phase() + "..."
+		}
 		affected = FormatNumber(r.TotalAffected)
 	case "pending":
 		icon = pendStyle.Render("⏳ pending")
@@ -254,16 +267,17 @@ func formatRow(r MigrationRecord, exec *Executor) string {
 }
 
 func progressBar(r MigrationRecord) string {
-	if !r.MaxID.Valid || r.MaxID.Int64 == 0 {
+	pct, ok := r.Progress()
+	if !ok {
 		return "—"
 	}
-	pct := float64(r.LastCompletedID) / float64(r.MaxID.Int64) * 100
-	filled := int(pct / 100 * 8)
-	if filled > 8 {
-		filled = 8
-	}
-	bar := strings.Repeat("█", filled) + strings.Repeat("░", 8-filled)
-	return fmt.Sprintf("[%s] %.0f%%", bar, pct)
+	return fmt.Sprintf("[%s] %.0f%%", renderBar(pct, 8), pct)
+}
+
+// renderBar draws a width-cell bar filled to pct percent.
+func renderBar(pct float64, width int) string {
+	filled := min(max(int(pct/100*float64(width)), 0), width)
+	return strings.Repeat("█", filled) + strings.Repeat("░", width-filled)
 }
 
 func (m Model) viewDetail() string {
@@ -299,42 +313,41 @@ func (m Model) viewDetail() string {
 		}
 		line("Batch", fmt.Sprintf("column=%s, chunk=%s, parallelism=%s", r.BatchColumn.String, chunk, par))
 
+		if r.MinID.Valid {
+			line("Min ID", FormatNumber(r.MinID.Int64))
+		}
 		if r.MaxID.Valid {
 			line("Max ID", FormatNumber(r.MaxID.Int64))
 		}
 		line("Current ID", FormatNumber(r.LastCompletedID))
 
 		// Progress bar
-		if r.MaxID.Valid && r.MaxID.Int64 > 0 {
-			pct := float64(r.LastCompletedID) / float64(r.MaxID.Int64) * 100
-			filled := int(pct / 100 * 40)
-			if filled > 40 {
-				filled = 40
-			}
-			bar := strings.Repeat("█", filled) + strings.Repeat("░", 40-filled)
-			line("Progress", fmt.Sprintf("[%s] %.1f%%", bar, pct))
+		if pct, ok := r.Progress(); ok {
+			line("Progress", fmt.Sprintf("[%s] %.1f%%", renderBar(pct, 40), pct))
 		}
 	}
 
 	line("Affected", FormatNumber(r.TotalAffected)+" rows")
 	line("Errors", fmt.Sprintf("%d", r.ErrorCount))
+	if r.FailedChunks.Valid {
+		line("Failed", r.FailedChunks.String)
+	}
 
 	// Rate and ETA from executor state
 	if es := m.daemon.Executor.GetState(r.Name); es != nil {
-		rate := es.Rate.Load()
-		if rate > 0 {
+		if rate := es.Rate.Load(); rate > 0 {
 			line("Rate", fmt.Sprintf("~%s rows/sec", FormatNumber(rate)))
-			if r.MaxID.Valid && r.MaxID.Int64 > 0 {
-				remaining := r.MaxID.Int64 - r.LastCompletedID
-				etaSec := remaining / rate
-				if etaSec > 3600 {
-					line("ETA", fmt.Sprintf("%dh %dm", etaSec/3600, (etaSec%3600)/60))
-				} else if etaSec > 60 {
-					line("ETA", fmt.Sprintf("%dm %ds", etaSec/60, etaSec%60))
-				} else {
-					line("ETA", fmt.Sprintf("%ds", etaSec))
-				}
-			}
+		}
+		if phase := es.Phase(); phase != "" {
+			line("Phase", phase)
+		}
+		if es.Paused.Load() {
+			lag := time.Duration(es.ReplicaLag.Load()).Round(time.Second)
+			line("Throttled", fmt.Sprintf("paused, replica lag %s", lag))
+		}
+		if eta, ok := es.ETA(); ok {
+			line("ETA", FormatETA(eta))
+			line("Est. done", time.Now().Add(eta).Format("2006-01-02 15:04:05"))
 		}
 	}
 
@@ -351,6 +364,61 @@ func (m Model) viewDetail() string {
 	}
 
 	b.WriteString("\n")
-	b.WriteString(helpStyle.Render(" [c] cancel  [b] back  [q] quit"))
+	b.WriteString(helpStyle.Render(" [c] cancel  [p] preview  [b] back  [q] quit"))
 	return b.String()
 }
+
+func (m Model) viewPreview() string {
+	r := m.selectedRecord()
+	if r == nil {
+		return "No migration selected"
+	}
+
+	var b strings.Builder
+	b.WriteString(titleStyle.Render(fmt.Sprintf("psc - preview %s", r.Name)) + "\n\n")
+
+	mig := m.daemon.GetMigration(r.Name)
+	if mig == nil {
+		b.WriteString(errStyle.Render(" Migration file not loaded") + "\n\n")
+		b.WriteString(helpStyle.Render(" [b] back  [q] quit"))
+		return b.String()
+	}
+
+	if len(mig.Settings) > 0 {
+		b.WriteString(headerStyle.Render(" Session settings:") + "\n")
+		names := make([]string, 0, len(mig.Settings))
+		for name := range mig.Settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			b.WriteString(valStyle.Render(fmt.Sprintf("   %s = %s", name, mig.Settings[name])) + "\n")
+		}
+		b.WriteString("\n")
+	}
+
+	if mig.IsBatched() {
+		start := resumeStart(r, r.MinID.Int64)
+		end := start + int64(mig.ChunkSize) - 1
+
+		b.WriteString(headerStyle.Render(" ID range query:") + "\n")
+		b.WriteString(valStyle.Render(indent(idRangeQuery(mig))) + "\n\n")
+		header := fmt.Sprintf(" First chunk (%s-%s):", FormatNumber(start), FormatNumber(end))
+		if !r.HasCheckpoint() {
+			header = fmt.Sprintf(" First chunk (%s-%s; a fresh run starts at the MIN from the range query):",
+				FormatNumber(start), FormatNumber(end))
+		}
+		b.WriteString(headerStyle.Render(header) + "\n")
+		b.WriteString(valStyle.Render(indent(expandChunkSQL(mig.SQL, start, end))) + "\n\n")
+	} else {
+		b.WriteString(headerStyle.Render(" Statement:") + "\n")
+		b.WriteString(valStyle.Render(indent(mig.SQL)) + "\n\n")
+	}
+
+	b.WriteString(helpStyle.Render(" [b] back  [q] quit"))
+	return b.String()
+}
+
+func indent(s string) string {
+	return "   " + strings.ReplaceAll(s, "\n", "\n   ")
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// migrationNameRe restricts migration names to characters that are safe in
+// file names, advisory lock keys and log lines.
+var migrationNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// settingNameRe matches PostgreSQL configuration parameter names.
+var settingNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func validateSettingName(name string) error {
+	if !settingNameRe.MatchString(name) {
+		return fmt.Errorf("invalid setting name %q", name)
+	}
+	return nil
+}
+
+// validateMigration checks a parsed migration for directive values that would
+// otherwise fail (or misbehave) only once it runs.
+func validateMigration(m *Migration) error {
+	if !migrationNameRe.MatchString(m.Name) {
+		return fmt.Errorf("invalid migration name %q: use letters, digits, '_', '-' and '.'", m.Name)
+	}
+	if m.OnError != "abort" && m.OnError != "continue" {
+		return fmt.Errorf("invalid on_error %q: must be abort or continue", m.OnError)
+	}
+	if m.After != "" && extractTableForMax(m.SQL) == "unknown_table" {
+		return fmt.Errorf("psc:after %s: could not determine the table from the migration SQL", m.After)
+	}
+	if !m.IsBatched() {
+		return nil
+	}
+	if parts, n := scanIdentParts(m.BatchColumn); n != len(m.BatchColumn) || len(parts) != 1 {
+		return fmt.Errorf("invalid batch column %q", m.BatchColumn)
+	}
+	if m.ChunkSize < 1 {
+		return fmt.Errorf("invalid chunk size %d: must be positive", m.ChunkSize)
+	}
+	if m.Parallelism < 1 {
+		return fmt.Errorf("invalid parallelism %d: must be positive", m.Parallelism)
+	}
+	if !strings.Contains(m.SQL, ":start") || !strings.Contains(m.SQL, ":end") {
+		return fmt.Errorf("batched migration SQL must contain :start and :end placeholders")
+	}
+	return nil
+}
+
+// ValidationError reports a migration that cannot run as written, as opposed
+// to one that failed while running.
+type ValidationError struct {
+	Err error
+}
+
+func (e *ValidationError) Error() string { return e.Err.Error() }
+func (e *ValidationError) Unwrap() error { return e.Err }
+
+// invalidf formats a ValidationError.
+func invalidf(format string, args ...any) error {
+	return &ValidationError{Err: fmt.Errorf(format, args...)}
+}
+
+// checkBatchTarget verifies against the target catalog that the table found in
+// the migration SQL exists and has the batch column.
+func checkBatchTarget(ctx context.Context, db *sql.DB, m *Migration) error {
+	table := extractTableForMax(m.SQL)
+	if table == "unknown_table" {
+		return invalidf("could not determine the table to batch over from the migration SQL")
+	}
+
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT to_regclass($1) IS NOT NULL`, quoteQualifiedIdent(table)).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("checking table %s: %w", table, err)
+	}
+	if !exists {
+		return invalidf("table %s does not exist", table)
+	}
+
+	column := identName(m.BatchColumn)
+	err = db.QueryRowContext(ctx, `
+		SELECT EXISTS (
+			SELECT 1 FROM pg_attribute
+			WHERE attrelid = to_regclass($1) AND attname = $2 AND attnum > 0 AND NOT attisdropped
+		)`, quoteQualifiedIdent(table), column).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("checking column %s: %w", column, err)
+	}
+	if !exists {
+		return invalidf("column %q not found on table %s", column, table)
+	}
+	return nil
+}
+
+// identName returns the catalog name of a single identifier as written in SQL:
+// quoted names are unquoted, unquoted names are folded to lower case.
+func identName(ident string) string {
+	if strings.HasPrefix(ident, `"`) && strings.HasSuffix(ident, `"`) && len(ident) >= 2 {
+		return strings.ReplaceAll(ident[1:len(ident)-1], `""`, `"`)
+	}
+	return strings.ToLower(ident)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateMigration(t *testing.T) {
+	valid := func() *Migration {
+		return &Migration{
+			Name:        "backfill_emails-2024.1",
+			OnError:     "abort",
+			BatchColumn: "id",
+			ChunkSize:   1000,
+			Parallelism: 2,
+			SQL:         "UPDATE users SET x = 1 WHERE id BETWEEN :start AND :end",
+		}
+	}
+	tests := []struct {
+		name   string
+		modify func(m *Migration)
+		err    string // "" if valid
+	}{
+		{"valid batched", func(m *Migration) {}, ""},
+		{"valid unbatched", func(m *Migration) { m.BatchColumn = ""; m.SQL = "VACUUM" }, ""},
+		{"quoted batch column", func(m *Migration) { m.BatchColumn = `"Id"` }, ""},
+		{"name with space", func(m *Migration) { m.Name = "backfill emails" }, "invalid migration name"},
+		{"name with quote", func(m *Migration) { m.Name = "x'y" }, "invalid migration name"},
+		{"unknown on_error", func(m *Migration) { m.OnError = "skip" }, "invalid on_error"},
+		{"after without a table", func(m *Migration) { m.After = "analyze"; m.SQL = "SELECT 1 WHERE :start < :end" }, "psc:after analyze"},
+		{"qualified batch column", func(m *Migration) { m.BatchColumn = "users.id" }, "invalid batch column"},
+		{"batch column expression", func(m *Migration) { m.BatchColumn = "id; DROP TABLE users" }, "invalid batch column"},
+		{"zero chunk", func(m *Migration) { m.ChunkSize = 0 }, "invalid chunk size"},
+		{"zero parallelism", func(m *Migration) { m.Parallelism = 0 }, "invalid parallelism"},
+		{"missing :end", func(m *Migration) { m.SQL = "UPDATE users SET x = 1 WHERE id >= :start" }, ":start and :end"},
+		// Placeholders and chunk settings only matter for batched migrations.
+		{"unbatched without placeholders", func(m *Migration) {
+			m.BatchColumn, m.ChunkSize = "", 0
+			m.SQL = "DELETE FROM sessions WHERE expired"
+		}, ""},
+	}
+	for _, tt := range tests {
+		m := valid()
+		tt.modify(m)
+		err := validateMigration(m)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error = %v, want one containing %q", tt.name, err, tt.err)
+		}
+	}
+}